@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/bulk"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/daemon"
+	"github.com/guoyk93/esbridge/jobs"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
+	"github.com/olivere/elastic"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	JobMigrate = "migrate"
+	JobRestore = "restore"
+	JobSearch  = "search"
+	JobVerify  = "verify"
+)
+
+// JobRequest 通过 API 提交任务的参数
+type JobRequest struct {
+	Kind string `json:"kind"`
+	// Index 和 Pattern 用于 migrate，Pattern 按 OlderThan 选择索引
+	Index     string `json:"index,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	OlderThan int    `json:"older_than,omitempty"`
+	NoDelete  bool   `json:"no_delete,omitempty"`
+	// Selector 用于 restore 和 verify，格式与 -restore 相同
+	Selector string  `json:"selector,omitempty"`
+	Mode     string  `json:"mode,omitempty"`
+	Template string  `json:"template,omitempty"`
+	Target   string  `json:"target,omitempty"`
+	Alias    *string `json:"alias,omitempty"`
+	// DeadLetter 为空时使用配置文件或者命令行中的设置
+	DeadLetter *string `json:"dead_letter,omitempty"`
+	// Filter 恢复时的过滤条件，From 和 To 按 TimestampField 过滤时间范围
+	Filter         json.RawMessage `json:"filter,omitempty"`
+	From           string          `json:"from,omitempty"`
+	To             string          `json:"to,omitempty"`
+	TimestampField string          `json:"timestamp_field,omitempty"`
+	// VerifyFirst 恢复前先下载并校验归档
+	VerifyFirst bool `json:"verify_first,omitempty"`
+	// Keyword 用于 search
+	Keyword string `json:"keyword,omitempty"`
+}
+
+// restoreFilter 解析恢复时的过滤条件，不允许从文件读取
+func (jr JobRequest) restoreFilter() (tasks.Filter, error) {
+	field := jr.TimestampField
+	if field == "" {
+		field = optTimestamp
+	}
+	var filter string
+	if len(jr.Filter) > 0 && string(jr.Filter) != "null" {
+		if !strings.HasPrefix(strings.TrimSpace(string(jr.Filter)), "{") {
+			return nil, errors.New("filter 必须是 JSON 对象")
+		}
+		filter = string(jr.Filter)
+	}
+	return ParseRestoreFilter(filter, field, jr.From, jr.To)
+}
+
+type apiServer struct {
+	manager  *jobs.Manager
+	daemon   *daemon.Daemon
+	store    storage.Storage
+	clientES *elastic.Client
+	info     cluster.Info
+	engine   string
+	token    string
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, map[string]string{"error": err.Error()})
+}
+
+// RegisterAPI 在 mux 上注册任务接口
+func RegisterAPI(mux *http.ServeMux, s *apiServer) {
+	mux.HandleFunc("/api/jobs", s.auth(s.handleJobs))
+	mux.HandleFunc("/api/jobs/", s.auth(s.handleJob))
+	mux.HandleFunc("/api/daemon/jobs", s.auth(s.handleDaemonJobs))
+	mux.HandleFunc("/api/restore/rate-limit", s.auth(s.handleRateLimit))
+}
+
+func (s *apiServer) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(rw, http.StatusUnauthorized, errors.New("未授权"))
+			return
+		}
+		h(rw, req)
+	}
+}
+
+func (s *apiServer) handleJobs(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, s.manager.List())
+	case http.MethodPost:
+		var jr JobRequest
+		if err := json.NewDecoder(req.Body).Decode(&jr); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		task, err := s.buildTask(jr)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(rw, http.StatusAccepted, s.manager.Submit(jr.Kind, jr, task))
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, errors.New("不支持的请求方法"))
+	}
+}
+
+// handleJob 处理 /api/jobs/ID, /api/jobs/ID/logs 和 /api/jobs/ID/cancel
+func (s *apiServer) handleJob(rw http.ResponseWriter, req *http.Request) {
+	ss := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/jobs/"), "/"), "/")
+	id, action := ss[0], ""
+	if len(ss) > 1 {
+		action = ss[1]
+	}
+	switch {
+	case action == "" && req.Method == http.MethodGet:
+		j, err := s.manager.Get(id)
+		if err != nil {
+			writeError(rw, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, j)
+	case (action == "" && req.Method == http.MethodDelete) || (action == "cancel" && req.Method == http.MethodPost):
+		if err := s.manager.Cancel(id); err != nil {
+			code := http.StatusConflict
+			if err == jobs.ErrNotFound {
+				code = http.StatusNotFound
+			}
+			writeError(rw, code, err)
+			return
+		}
+		j, _ := s.manager.Get(id)
+		writeJSON(rw, http.StatusOK, j)
+	case action == "logs" && req.Method == http.MethodGet:
+		s.streamLogs(rw, req, id)
+	default:
+		writeError(rw, http.StatusNotFound, errors.New("未知的接口"))
+	}
+}
+
+// streamLogs 持续输出任务的日志，直到任务结束
+func (s *apiServer) streamLogs(rw http.ResponseWriter, req *http.Request, id string) {
+	done, err := s.manager.Done(id)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+	var logs *jobs.LogBuffer
+	if logs, err = s.manager.Logs(id); err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var next int64
+	for {
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		var lines []string
+		lines, next = logs.Read(next, -1)
+		for _, line := range lines {
+			if _, err := rw.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			j, _ := s.manager.Get(id)
+			_, _ = rw.Write([]byte("任务状态: " + j.Status + "\n"))
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-done:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *apiServer) handleDaemonJobs(rw http.ResponseWriter, req *http.Request) {
+	if s.daemon == nil {
+		writeError(rw, http.StatusNotFound, errors.New("没有配置归档策略"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.daemon.Jobs())
+}
+
+// restoreItems 根据请求生成恢复任务
+func (s *apiServer) restoreItems(ctx context.Context, jr JobRequest) (items []*RestoreItem, err error) {
+	var pairs [][2]string
+	if pairs, err = ResolveRestoreSelectors(ctx, s.store, jr.Selector); err != nil {
+		return
+	}
+	var bo bulk.Options
+	if bo, err = restoreBulkOptions(); err != nil {
+		return
+	}
+	deadLetter := restoreDeadLetter()
+	if jr.DeadLetter != nil {
+		deadLetter = *jr.DeadLetter
+	}
+	var filter tasks.Filter
+	if filter, err = jr.restoreFilter(); err != nil {
+		return
+	}
+	for _, pair := range pairs {
+		var tpl RestoreTemplate
+		if tpl, err = ResolveRestoreTemplate(conf, jr.Template, pair[0]); err != nil {
+			return
+		}
+		if jr.Target != "" {
+			tpl.Target = jr.Target
+		}
+		if jr.Alias != nil {
+			tpl.Alias = *jr.Alias
+		}
+		items = append(items, &RestoreItem{RestoreOptions: RestoreOptions{
+			Index:         pair[0],
+			Project:       pair[1],
+			Mode:          jr.Mode,
+			Template:      tpl,
+			Bulk:          bo,
+			DeadLetter:    deadLetter,
+			DeadLetterDir: deadLetterDir(),
+			Filter:        filter,
+			VerifyFirst:   jr.VerifyFirst,
+		}})
+	}
+	return
+}
+
+func (s *apiServer) buildTask(jr JobRequest) (task conc.Task, err error) {
+	switch jr.Kind {
+	case JobMigrate:
+		if jr.Index == "" && jr.Pattern == "" {
+			err = errors.New("缺少 index 或者 pattern")
+			return
+		}
+		migrate := func(index string) conc.Task {
+			opts := migrateOptions(index, s.store, s.clientES, s.info, s.engine)
+			opts.NoDelete = opts.NoDelete || jr.NoDelete
+			return migrateIndex(opts)
+		}
+		if jr.Index != "" {
+			if err = checkIndex(jr.Index); err != nil {
+				return
+			}
+			task = migrate(jr.Index)
+			return
+		}
+		// older_than 为 0 时会选中正在写入的索引并删除
+		if jr.OlderThan <= 0 {
+			err = errors.New("使用 pattern 时 older_than 必须大于 0")
+			return
+		}
+		task = conc.TaskFunc(func(ctx context.Context) (err error) {
+			var candidates []tasks.IndexCandidate
+			if candidates, err = tasks.SelectIndices(ctx, tasks.IndexSelectOptions{
+				ESClient:  s.clientES,
+				Storage:   s.store,
+				Pattern:   jr.Pattern,
+				OlderThan: time.Duration(jr.OlderThan) * 24 * time.Hour,
+			}); err != nil {
+				return
+			}
+			return MigrateBatch(ctx, candidates, optIndexConcurrency, migrate)
+		})
+	case JobRestore:
+		if jr.Mode == "" {
+			jr.Mode = RestoreModeOverwrite
+		}
+		if err = checkRestoreMode(jr.Mode); err != nil {
+			return
+		}
+		if jr.DeadLetter != nil {
+			if err = checkDeadLetter(*jr.DeadLetter); err != nil {
+				return
+			}
+		}
+		if _, err = jr.restoreFilter(); err != nil {
+			return
+		}
+		if strings.TrimSpace(jr.Selector) == "" {
+			err = errors.New("缺少 selector")
+			return
+		}
+		task = conc.TaskFunc(func(ctx context.Context) (err error) {
+			var items []*RestoreItem
+			if items, err = s.restoreItems(ctx, jr); err != nil {
+				return
+			}
+			return Restore(ctx, items, optConcurrency, s.store, s.clientES, s.info)
+		})
+	case JobVerify:
+		if strings.TrimSpace(jr.Selector) == "" {
+			err = errors.New("缺少 selector")
+			return
+		}
+		task = conc.TaskFunc(func(ctx context.Context) (err error) {
+			return VerifySelectors(ctx, s.store, jr.Selector)
+		})
+	case JobSearch:
+		if strings.TrimSpace(jr.Keyword) == "" {
+			err = errors.New("缺少 keyword")
+			return
+		}
+		task = conc.TaskFunc(func(ctx context.Context) error {
+			return StorageSearch(ctx, s.store, jr.Keyword)
+		})
+	default:
+		err = errors.New("未知的任务类型: " + jr.Kind)
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/daemon"
+	"github.com/guoyk93/esbridge/jobs"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
+	"github.com/olivere/elastic"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	FileHistory = "_history.json"
+
+	// apiLogLines 任务接口为每个任务保留的日志行数
+	apiLogLines = 10000
+)
+
+// Serve 常驻运行，按归档策略定时迁移索引，并提供任务接口，收到 SIGINT 或 SIGTERM 后退出
+func Serve(store storage.Storage, clientES *elastic.Client, info cluster.Info, engine string) (err error) {
+	if len(conf.Daemon.Policies) == 0 && !conf.API.Enabled {
+		err = errors.New("没有配置归档策略，也没有启用任务接口")
+		return
+	}
+
+	var d *daemon.Daemon
+	if len(conf.Daemon.Policies) > 0 {
+		file := conf.Daemon.History
+		if file == "" {
+			file = filepath.Join(conf.Workspace, FileHistory)
+		}
+		if d, err = daemon.New(conf.Daemon.Policies, file, func(ctx context.Context, p daemon.Policy, job *daemon.Job) (err error) {
+			var candidates []tasks.IndexCandidate
+			if candidates, err = tasks.SelectIndices(ctx, tasks.IndexSelectOptions{
+				ESClient:   clientES,
+				Storage:    store,
+				Pattern:    p.Pattern,
+				OlderThan:  time.Duration(p.OlderThan) * 24 * time.Hour,
+				DateLayout: p.DateLayout,
+			}); err != nil {
+				return
+			}
+			for _, c := range candidates {
+				job.Indices = append(job.Indices, c.Index)
+			}
+			return MigrateBatch(ctx, candidates, p.Concurrency, func(index string) conc.Task {
+				opts := migrateOptions(index, store, clientES, info, engine)
+				opts.NoDelete = optNoDelete || !p.ShouldDelete()
+				opts.StorageClass = p.StorageClass
+				// 被中断的迁移从之前的进度继续
+				opts.Resume = true
+				return migrateIndex(opts)
+			})
+		}); err != nil {
+			return
+		}
+		log.Printf("归档策略任务历史: %s", file)
+	}
+
+	if conf.API.Enabled {
+		RegisterAPI(http.DefaultServeMux, &apiServer{
+			manager:  jobs.NewManager(conf.API.MaxJobs, apiLogLines),
+			daemon:   d,
+			store:    store,
+			clientES: clientES,
+			info:     info,
+			engine:   engine,
+			token:    conf.API.Token,
+		})
+		log.Printf("任务接口: http://%s/api/jobs", conf.PProf.Bind)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		chSig := make(chan os.Signal, 1)
+		signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-chSig
+		log.Printf("收到信号 %s，正在退出", sig.String())
+		cancel()
+	}()
+
+	if d != nil {
+		err = d.Run(ctx)
+	} else {
+		<-ctx.Done()
+		err = ctx.Err()
+	}
+	if err == context.Canceled {
+		err = nil
+	}
+	return
+}
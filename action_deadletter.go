@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/olivere/elastic"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DeadLetterLocal 将无法恢复的文档写入工作目录下的文件
+	DeadLetterLocal = "local"
+	// DeadLetterStorage 将无法恢复的文档上传到存储中的 INDEX/PROJECT.deadletter.ndjson.gz
+	DeadLetterStorage = "storage"
+
+	// FailureMalformed 归档中无法解析的行
+	FailureMalformed = "malformed_record"
+)
+
+func checkDeadLetter(mode string) error {
+	switch mode {
+	case "", DeadLetterLocal, DeadLetterStorage:
+		return nil
+	default:
+		return errors.New("未知的死信模式: " + mode)
+	}
+}
+
+// DeadLetter 死信文件中的一行，包含归档中的记录和失败原因，修复后可以作为归档重新恢复
+type DeadLetter struct {
+	tasks.Record
+	// Line 无法解析的原始行，此时 Record 为空
+	Line   string                `json:"line,omitempty"`
+	Target string                `json:"target"`
+	Status int                   `json:"status"`
+	Error  *elastic.ErrorDetails `json:"error,omitempty"`
+}
+
+// failureType 失败的分类，优先使用错误类型
+func failureType(item *elastic.BulkResponseItem) string {
+	if item.Error != nil && item.Error.Type != "" {
+		return item.Error.Type
+	}
+	return "status_" + strconv.Itoa(item.Status)
+}
+
+// formatFailures 按错误类型输出失败的文档数
+func formatFailures(failures map[string]int64) string {
+	if len(failures) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(failures))
+	for k := range failures {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, fmt.Sprintf("%s=%d", k, failures[k]))
+	}
+	return strings.Join(out, ",")
+}
+
+// deadLetterWriter 写入无法恢复的文档，第一次写入时才创建文件
+type deadLetterWriter struct {
+	mode    string
+	dir     string
+	index   string
+	project string
+	store   storage.Storage
+
+	file  *os.File
+	zw    *gzip.Writer
+	count int64
+}
+
+func newDeadLetterWriter(opts RestoreOptions, store storage.Storage) *deadLetterWriter {
+	return &deadLetterWriter{
+		mode:    opts.DeadLetter,
+		dir:     opts.DeadLetterDir,
+		index:   opts.Index,
+		project: opts.Project,
+		store:   store,
+	}
+}
+
+func (w *deadLetterWriter) filename() string {
+	return filepath.Join(w.dir, w.index, w.project+tasks.ExtDeadLetter)
+}
+
+func (w *deadLetterWriter) key() string {
+	return w.index + "/" + w.project + tasks.ExtDeadLetter
+}
+
+func (w *deadLetterWriter) Write(dl DeadLetter) (err error) {
+	if w.file == nil {
+		if err = os.MkdirAll(filepath.Dir(w.filename()), 0755); err != nil {
+			return
+		}
+		if w.file, err = os.OpenFile(w.filename(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+			return
+		}
+		w.zw = gzip.NewWriter(w.file)
+	}
+	var buf []byte
+	if buf, err = json.Marshal(dl); err != nil {
+		return
+	}
+	if _, err = w.zw.Write(append(buf, '\n')); err != nil {
+		return
+	}
+	w.count++
+	return
+}
+
+// Close 关闭文件，存储模式下上传后删除本地文件
+func (w *deadLetterWriter) Close(ctx context.Context) (err error) {
+	if w.file == nil {
+		return
+	}
+	if err = w.zw.Close(); err != nil {
+		return
+	}
+	if err = w.file.Close(); err != nil {
+		return
+	}
+	w.file = nil
+	if w.mode != DeadLetterStorage {
+		joblog.Printf(ctx, "无法恢复的文档已经写入: %s, 文档数 = %d", w.filename(), w.count)
+		return
+	}
+	if err = w.store.Put(ctx, w.key(), w.filename(), storage.PutOptions{}); err != nil {
+		return
+	}
+	joblog.Printf(ctx, "无法恢复的文档已经上传: %s, 文档数 = %d", w.key(), w.count)
+	return os.Remove(w.filename())
+}
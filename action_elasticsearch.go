@@ -2,59 +2,82 @@ package main
 
 import (
 	"context"
+	"errors"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/tasks"
 	"github.com/olivere/elastic"
-	"log"
+	"strings"
 )
 
 type M map[string]interface{}
 
-func ElasticsearchTouchIndex(clientES *elastic.Client, index string) (err error) {
-	log.Printf("确保索引存在: %s", index)
+// parseAllocation 解析形如 require.disktype=hdd,exclude._name=node-1 的分配设置
+func parseAllocation(s string) (out map[string]string, err error) {
+	out = map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			err = errors.New("无效的分配设置: " + item)
+			return
+		}
+		out[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return
+}
+
+func ElasticsearchTouchIndex(ctx context.Context, clientES *elastic.Client, index string, meta *tasks.IndexMeta, tpl RestoreTemplate, info cluster.Info) (err error) {
+	joblog.Printf(ctx, "确保索引存在: %s", index)
 	var ok bool
 	if ok, err = clientES.IndexExists(index).Do(context.Background()); err != nil {
 		return
 	}
-	if !ok {
-		if _, err = clientES.CreateIndex(index).BodyJson(M{
-			"settings": M{
-				"index": M{
-					"number_of_replicas": "0",
-					"number_of_shards":   "6",
-					"routing": M{
-						"allocation": M{
-							"exclude": M{
-								"disktype": nil,
-							},
-							"require": M{
-								"disktype": "hdd",
-							},
-						},
-					},
-				},
-			},
-		}).Do(context.Background()); err != nil {
+	if ok {
+		return
+	}
+	o := tpl.Overrides()
+	var body map[string]interface{}
+	if meta != nil {
+		joblog.Printf(ctx, "使用归档中的设置和映射创建索引: %s", index)
+		if body, err = meta.CreateBody(info, o); err != nil {
+			return
+		}
+	} else {
+		joblog.Printf(ctx, "没有找到归档中的设置和映射，使用默认设置创建索引: %s", index)
+		if o.Shards < 0 {
+			o.Shards = 6
+		}
+		if o.Replicas < 0 {
+			o.Replicas = 0
+		}
+		if body, err = (&tasks.IndexMeta{}).CreateBody(info, o); err != nil {
 			return
 		}
 	}
+	_, err = clientES.CreateIndex(index).BodyJson(body).Do(context.Background())
 	return
 }
 
-func ElasticsearchTuneForRecoveryStart(clientES *elastic.Client, index string) (err error) {
-	log.Printf("调整索引设置，为写入大量数据做准备: %s", index)
-	_, err = clientES.IndexPutSettings(index).FlatSettings(true).BodyJson(M{
-		"index.routing.allocation.exclude.disktype": nil,
-		"index.routing.allocation.require.disktype": "hdd",
-		"index.refresh_interval":                    "1m",
-	}).Do(context.Background())
+func ElasticsearchTuneForRecoveryStart(ctx context.Context, clientES *elastic.Client, index string, tpl RestoreTemplate) (err error) {
+	joblog.Printf(ctx, "调整索引设置，为写入大量数据做准备: %s", index)
+	settings := M{"index.refresh_interval": tpl.RecoveryRefreshInterval}
+	for k, v := range tpl.Allocation {
+		settings["index.routing.allocation."+k] = v
+	}
+	_, err = clientES.IndexPutSettings(index).FlatSettings(true).BodyJson(settings).Do(context.Background())
 	return
 }
 
-func ElasticsearchTuneForRecoveryEnd(clientES *elastic.Client, index string) (err error) {
-	log.Printf("恢复索引设置: %s", index)
-	_, err = clientES.IndexPutSettings(index).FlatSettings(true).BodyJson(M{
-		"index.routing.allocation.exclude.disktype": nil,
-		"index.routing.allocation.require.disktype": "hdd",
-		"index.refresh_interval":                    "10s",
-	}).Do(context.Background())
+func ElasticsearchTuneForRecoveryEnd(ctx context.Context, clientES *elastic.Client, index string, tpl RestoreTemplate) (err error) {
+	joblog.Printf(ctx, "恢复索引设置: %s", index)
+	settings := M{"index.refresh_interval": tpl.RefreshInterval}
+	for k, v := range tpl.Allocation {
+		settings["index.routing.allocation."+k] = v
+	}
+	_, err = clientES.IndexPutSettings(index).FlatSettings(true).BodyJson(settings).Do(context.Background())
 	return
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/tasks"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	migratingLock sync.Mutex
+	migrating     = map[string]bool{}
+)
+
+// lockMigration 同一个索引同时只允许一个迁移，否则会写入同一个进度文件和描述文件，并且重复删除索引
+func lockMigration(index string) (unlock func(), err error) {
+	migratingLock.Lock()
+	defer migratingLock.Unlock()
+	if migrating[index] {
+		err = errors.New("索引正在迁移中: " + index)
+		return
+	}
+	migrating[index] = true
+	unlock = func() {
+		migratingLock.Lock()
+		defer migratingLock.Unlock()
+		delete(migrating, index)
+	}
+	return
+}
+
+type migrateResult struct {
+	tasks.IndexCandidate
+	Duration time.Duration
+	Err      error
+}
+
+// MigrateBatch 按日期顺序迁移多个索引，单个索引失败不影响其他索引
+func MigrateBatch(ctx context.Context, candidates []tasks.IndexCandidate, concurrency int, migrate func(index string) conc.Task) (err error) {
+	if len(candidates) == 0 {
+		joblog.Printf(ctx, "没有需要迁移的索引")
+		return
+	}
+	names := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		names = append(names, c.Index)
+	}
+	joblog.Printf(ctx, "准备迁移 %d 个索引: %s", len(candidates), strings.Join(names, ", "))
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*migrateResult, 0, len(candidates))
+	runs := make([]conc.Task, 0, len(candidates))
+	for _, c := range candidates {
+		r := &migrateResult{IndexCandidate: c}
+		results = append(results, r)
+		runs = append(runs, conc.TaskFunc(func(ctx context.Context) error {
+			joblog.Printf(ctx, "开始迁移索引: %s (%s, %s)", r.Index, r.Date.Format("2006-01-02"), r.DateSource)
+			start := time.Now()
+			r.Err = migrate(r.Index).Do(ctx)
+			r.Duration = time.Since(start)
+			if r.Err != nil {
+				joblog.Printf(ctx, "迁移索引失败: %s: %s", r.Index, r.Err.Error())
+			}
+			return r.Err
+		}))
+	}
+	_ = conc.ParallelFailSafeWithLimit(concurrency, runs...).Do(ctx)
+
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "索引\t日期\t耗时\t结果\t")
+	var failed int
+	for _, r := range results {
+		result := "成功"
+		if r.Err != nil {
+			failed++
+			result = "失败: " + r.Err.Error()
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", r.Index, r.Date.Format("2006-01-02"), r.Duration.Round(time.Second), result)
+	}
+	_ = tw.Flush()
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		joblog.Println(ctx, line)
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d 个索引迁移失败", failed)
+		return
+	}
+	return
+}
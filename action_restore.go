@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/bulk"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
+	"github.com/guoyk93/logutil"
+	"github.com/olivere/elastic"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DefaultRestoreTarget = "{index}"
+	DefaultRestoreAlias  = "{index}-restored"
+)
+
+type RestoreOptions struct {
+	Index    string
+	Project  string
+	Mode     string
+	Template RestoreTemplate
+	Bulk     bulk.Options
+	// DeadLetter 无法恢复的文档的处理方式，为空时恢复失败
+	DeadLetter string
+	// DeadLetterDir 死信文件所在的本地目录
+	DeadLetterDir string
+	// Filter 只恢复满足条件的文档，为空时恢复所有文档
+	Filter tasks.Filter
+	// VerifyFirst 写入目标索引之前先下载并校验归档，否则在恢复过程中校验
+	VerifyFirst bool
+}
+
+// renderIndexName 替换名称模板中的 {index} 和 {project}
+func renderIndexName(tpl, index, project string) (name string, err error) {
+	name = strings.NewReplacer("{index}", index, "{project}", project).Replace(tpl)
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		err = errors.New("索引名称为空: " + tpl)
+		return
+	}
+	if strings.ContainsAny(name, "{}") {
+		err = errors.New("未知的名称模板: " + tpl)
+		return
+	}
+	if strings.ContainsAny(name, "*?\"<>|/\\, #:") || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "-") {
+		err = errors.New("无效的索引名称: " + name)
+		return
+	}
+	return
+}
+
+// Target 恢复的目标索引
+func (opts RestoreOptions) Target() (string, error) {
+	tpl := opts.Template.Target
+	if tpl == "" {
+		tpl = DefaultRestoreTarget
+	}
+	return renderIndexName(tpl, opts.Index, opts.Project)
+}
+
+// Alias 目标索引与原索引不同时创建的别名，为空时不创建
+func (opts RestoreOptions) Alias() (string, error) {
+	if opts.Template.Alias == "" {
+		return "", nil
+	}
+	return renderIndexName(opts.Template.Alias, opts.Index, opts.Project)
+}
+
+// RestoreItem 一个项目的恢复任务和结果
+type RestoreItem struct {
+	RestoreOptions
+	Target   string
+	Alias    string
+	Size     int64
+	Manifest *tasks.ProjectManifest
+	ImportResult
+	Duration time.Duration
+	Err      error
+}
+
+// hasGlob 是否包含通配符
+func hasGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func splitList(s string) (out []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return
+}
+
+// ParseRestoreFilter 解析恢复时的过滤条件，filter 以 '@' 开头时从文件中读取，
+// from 和 to 按 field 字段过滤时间范围，from 包含，to 不包含
+func ParseRestoreFilter(filter string, field string, from string, to string) (f tasks.Filter, err error) {
+	var fq tasks.Filter
+	if filter = strings.TrimSpace(filter); filter != "" {
+		buf := []byte(filter)
+		if strings.HasPrefix(filter, "@") {
+			if buf, err = ioutil.ReadFile(filter[1:]); err != nil {
+				return
+			}
+		}
+		if fq, err = tasks.ParseFilter(buf); err != nil {
+			return
+		}
+	}
+	var ft tasks.Filter
+	if ft, err = tasks.NewTimeRangeFilter(field, strings.TrimSpace(from), strings.TrimSpace(to)); err != nil {
+		return
+	}
+	f = tasks.AndFilter(ft, fq)
+	return
+}
+
+// ResolveRestoreSelectors 解析恢复参数，格式为 INDEX/PROJECT，多个以空格或者分号分隔，
+// INDEX 和 PROJECT 都可以是以逗号分隔的列表，支持通配符
+func ResolveRestoreSelectors(ctx context.Context, store storage.Storage, selectors string) (pairs [][2]string, err error) {
+	seen := map[[2]string]bool{}
+	add := func(index, project string) {
+		pair := [2]string{index, project}
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, selector := range strings.FieldsFunc(selectors, func(r rune) bool { return r == ';' || r == ' ' || r == '\n' }) {
+		ss := strings.Split(selector, "/")
+		if len(ss) != 2 {
+			err = errors.New("参数错误: " + selector)
+			return
+		}
+		indices, projects := splitList(ss[0]), splitList(ss[1])
+		if len(indices) == 0 || len(projects) == 0 {
+			err = errors.New("参数缺失: " + selector)
+			return
+		}
+		for _, index := range indices {
+			if _, err = path.Match(index, ""); err != nil {
+				return
+			}
+			for _, project := range projects {
+				if _, err = path.Match(project, ""); err != nil {
+					return
+				}
+				if !hasGlob(index) && !hasGlob(project) {
+					add(index, project)
+					continue
+				}
+				// 使用通配符之前的部分作为前缀列出文件
+				prefix := index
+				if i := strings.IndexAny(index, "*?["); i >= 0 {
+					prefix = index[:i]
+				} else {
+					prefix = index + "/"
+				}
+				if err = store.List(ctx, prefix, func(o storage.Object) error {
+					if !tasks.IsArchiveKey(o.Key) {
+						return nil
+					}
+					ks := strings.Split(strings.TrimSuffix(o.Key, tasks.ExtCompressedNDJSON), "/")
+					if len(ks) != 2 {
+						return nil
+					}
+					if ok, _ := path.Match(index, ks[0]); !ok {
+						return nil
+					}
+					if ok, _ := path.Match(project, ks[1]); !ok {
+						return nil
+					}
+					add(ks[0], ks[1])
+					return nil
+				}); err != nil {
+					return
+				}
+			}
+		}
+	}
+	if len(pairs) == 0 {
+		err = errors.New("没有找到匹配的项目: " + selectors)
+		return
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	return
+}
+
+// restoreProgress 多个项目共享的恢复进度
+type restoreProgress struct {
+	lock sync.Mutex
+	prg  logutil.Progress
+}
+
+// itemProgress 单个项目的进度，累加到共享的进度中
+type itemProgress struct {
+	parent *restoreProgress
+	count  int64
+}
+
+func (p *itemProgress) SetTotal(total int64) {}
+
+func (p *itemProgress) SetCount(count int64) {
+	p.Add(count - p.count)
+}
+
+func (p *itemProgress) Add(d int64) {
+	p.count += d
+	p.parent.lock.Lock()
+	defer p.parent.lock.Unlock()
+	p.parent.prg.Add(d)
+}
+
+func (p *itemProgress) Incr() {
+	p.Add(1)
+}
+
+// Restore 从存储中恢复多个项目，同一个目标索引只准备一次，之后并发写入
+func Restore(ctx context.Context, items []*RestoreItem, concurrency int, store storage.Storage, clientES *elastic.Client, info cluster.Info) (err error) {
+	joblog.Printf(ctx, "准备恢复 %d 个项目", len(items))
+	var total int64
+	for _, item := range items {
+		if item.Target, err = item.RestoreOptions.Target(); err != nil {
+			return
+		}
+		if item.Target != item.Index {
+			if item.Alias, err = item.RestoreOptions.Alias(); err != nil {
+				return
+			}
+		}
+		if item.Size, err = StorageCheckFile(ctx, store, item.Index, item.Project); err != nil {
+			return
+		}
+		if item.Manifest, err = StorageCheckManifest(ctx, store, item.Index, item.Project, item.Size); err != nil {
+			return
+		}
+		total += item.Size
+	}
+
+	// 写入目标索引之前校验归档，避免导入损坏的数据
+	verifies := make([]conc.Task, 0, len(items))
+	for _, _item := range items {
+		item := _item
+		if !item.VerifyFirst || item.Manifest == nil {
+			continue
+		}
+		verifies = append(verifies, conc.TaskFunc(func(ctx context.Context) (err error) {
+			if _, err = storageVerifyArchive(ctx, store, item.Index, item.Project, item.Size, item.Manifest); err != nil {
+				err = fmt.Errorf("归档校验失败，没有写入目标索引: %s/%s: %s", item.Index, item.Project, err.Error())
+			}
+			return
+		}))
+	}
+	if err = conc.ParallelWithLimit(concurrency, verifies...).Do(ctx); err != nil {
+		return
+	}
+
+	// 准备目标索引，使用第一个恢复到该索引的项目的设置
+	prepared := map[string]bool{}
+	for _, item := range items {
+		if prepared[item.Target] {
+			continue
+		}
+		prepared[item.Target] = true
+		var meta *tasks.IndexMeta
+		if meta, err = tasks.LoadIndexMeta(ctx, store, item.Index); err != nil {
+			return
+		}
+		if err = ElasticsearchTouchIndex(ctx, clientES, item.Target, meta, item.Template, info); err != nil {
+			return
+		}
+		if err = ElasticsearchTuneForRecoveryStart(ctx, clientES, item.Target, item.Template); err != nil {
+			return
+		}
+		tpl, target := item.Template, item.Target
+		defer ElasticsearchTuneForRecoveryEnd(ctx, clientES, target, tpl)
+	}
+
+	var shared *restoreProgress
+	if len(items) > 1 {
+		shared = &restoreProgress{prg: logutil.NewProgress(logutil.LoggerFunc(joblog.Printer(ctx)), "恢复进度")}
+		shared.prg.SetTotal(total)
+	}
+
+	runs := make([]conc.Task, 0, len(items))
+	for _, _item := range items {
+		item := _item
+		runs = append(runs, conc.TaskFunc(func(ctx context.Context) error {
+			var prg logutil.Progress
+			if shared != nil {
+				prg = &itemProgress{parent: shared}
+			}
+			start := time.Now()
+			item.ImportResult, item.Err = StorageImportToES(ctx, store, item.RestoreOptions, item.Target, item.Size, item.Manifest, prg, clientES, info)
+			if item.Err == nil && item.Alias != "" && item.Alias != item.Target {
+				joblog.Printf(ctx, "创建别名: %s -> %s", item.Alias, item.Target)
+				_, item.Err = clientES.Alias().Add(item.Target, item.Alias).Do(ctx)
+			}
+			item.Duration = time.Since(start)
+			outcome := metrics.Outcome(item.Err)
+			metrics.Restores.With(item.Index, item.Project, outcome).Inc()
+			metrics.ObserveJob(metrics.KindProjectRestore, outcome, item.Duration)
+			if item.Err != nil {
+				joblog.Printf(ctx, "恢复失败: %s/%s: %s", item.Index, item.Project, item.Err.Error())
+			}
+			return item.Err
+		}))
+	}
+	// 单个项目失败不影响其他项目
+	_ = conc.ParallelFailSafeWithLimit(concurrency, runs...).Do(ctx)
+
+	var failed int
+	for _, line := range strings.Split(strings.TrimSpace(formatRestoreSummary(items)), "\n") {
+		joblog.Println(ctx, line)
+	}
+	for _, item := range items {
+		if item.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d 个项目恢复失败", failed)
+		return
+	}
+	return
+}
+
+func formatRestoreSummary(items []*RestoreItem) string {
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "索引\t项目\t目标索引\t文档数\t保留\t跳过\t重试\t无法恢复\t大小\t耗时\t结果\t")
+	for _, item := range items {
+		result := "成功"
+		if item.Err != nil {
+			result = "失败: " + item.Err.Error()
+		}
+		_, _ = fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%.2fMB\t%s\t%s\t\n",
+			item.Index, item.Project, item.Target, item.Documents, item.Kept, item.Skipped, item.Retried, formatFailures(item.Failures),
+			float64(item.Size)/1000000.0, item.Duration.Round(time.Second), result,
+		)
+	}
+	_ = tw.Flush()
+	return buf.String()
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guoyk93/esbridge/bulk"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
+	"github.com/guoyk93/iocount"
+	"github.com/guoyk93/logutil"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/olivere/elastic"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RestoreModeOverwrite 覆盖已经存在的文档
+	RestoreModeOverwrite = "overwrite"
+	// RestoreModeCreate 跳过已经存在的文档
+	RestoreModeCreate = "create"
+	// RestoreModeFail 遇到已经存在的文档时失败
+	RestoreModeFail = "fail"
+	// RestoreModeExternalVersion 使用归档中的 _version 作为外部版本，仅写入版本更新的文档
+	RestoreModeExternalVersion = "external-version"
+)
+
+func checkRestoreMode(mode string) error {
+	switch mode {
+	case RestoreModeOverwrite, RestoreModeCreate, RestoreModeFail, RestoreModeExternalVersion:
+		return nil
+	default:
+		return errors.New("未知的恢复模式: " + mode)
+	}
+}
+
+func StorageSearch(ctx context.Context, store storage.Storage, keyword string) (err error) {
+	joblog.Printf(ctx, "在存储中搜索: %s", keyword)
+	splits := strings.Split(keyword, ",")
+	for i, s := range splits {
+		splits[i] = strings.TrimSpace(s)
+	}
+	manifests := map[string]*tasks.Manifest{}
+	return store.List(ctx, "", func(o storage.Object) (err error) {
+		// 以 '_' 开头的为迁移过程中的元数据文件
+		if strings.HasPrefix(path.Base(o.Key), "_") || strings.HasSuffix(o.Key, tasks.ExtDeadLetter) {
+			return nil
+		}
+		if !strings.HasSuffix(o.Key, tasks.ExtCompressedNDJSON) {
+			joblog.Printf(ctx, "发现未知文件: %s", o.Key)
+			return nil
+		}
+		p := strings.TrimPrefix(strings.TrimSuffix(o.Key, tasks.ExtCompressedNDJSON), "/")
+		for _, s := range splits {
+			if !strings.Contains(p, s) {
+				return nil
+			}
+		}
+		ss := strings.Split(p, "/")
+		if len(ss) != 2 {
+			joblog.Printf(ctx, "发现未知文件: %s", o.Key)
+			return nil
+		}
+		m, ok := manifests[ss[0]]
+		if !ok {
+			if m, err = tasks.LoadManifest(ctx, store, ss[0]); err != nil {
+				return
+			}
+			manifests[ss[0]] = m
+		}
+		var pm *tasks.ProjectManifest
+		if m != nil {
+			pm = m.Projects[ss[1]]
+		}
+		if pm == nil {
+			joblog.Printf(ctx, "找到 INDEX = %s, PROJECT = %s, SIZE = %02f", ss[0], ss[1], float64(o.Size)/1000000.0)
+			return nil
+		}
+		joblog.Printf(ctx,
+			"找到 INDEX = %s, PROJECT = %s, SIZE = %02f, DOCS = %d, FROM = %s, TO = %s",
+			ss[0], ss[1], float64(o.Size)/1000000.0, pm.Documents,
+			formatManifestTime(pm.MinTimestamp), formatManifestTime(pm.MaxTimestamp),
+		)
+		if pm.CompressedBytes != o.Size {
+			joblog.Printf(ctx, "文件大小与描述文件不一致: %s, %d != %d", o.Key, o.Size, pm.CompressedBytes)
+		}
+		return nil
+	})
+}
+
+func formatManifestTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// StorageCheckManifest 读取描述文件中项目的记录并检查文件大小，没有描述文件时返回 nil
+func StorageCheckManifest(ctx context.Context, store storage.Storage, index, project string, size int64) (pm *tasks.ProjectManifest, err error) {
+	var m *tasks.Manifest
+	if m, err = tasks.LoadManifest(ctx, store, index); err != nil {
+		return
+	}
+	if m == nil {
+		joblog.Printf(ctx, "没有找到描述文件，跳过校验: %s", index)
+		return
+	}
+	if pm = m.Projects[project]; pm == nil {
+		err = fmt.Errorf("描述文件中不包含项目: %s/%s", index, project)
+		return
+	}
+	joblog.Printf(ctx,
+		"描述文件: 文档数 = %d, 压缩后大小 = %d, 原始大小 = %d, 时间范围 = %s ~ %s, 来源集群 = %s (%s %s)",
+		pm.Documents, pm.CompressedBytes, pm.UncompressedBytes,
+		formatManifestTime(pm.MinTimestamp), formatManifestTime(pm.MaxTimestamp),
+		m.Cluster.Name, m.Cluster.Distribution, m.Cluster.Version,
+	)
+	if pm.CompressedBytes != size {
+		err = fmt.Errorf("文件大小与描述文件不一致: %d != %d", size, pm.CompressedBytes)
+		return
+	}
+	return
+}
+
+func StorageCheckFile(ctx context.Context, store storage.Storage, index, project string) (size int64, err error) {
+	joblog.Printf(ctx, "检查存储文件: INDEX = %s, PROJECT = %s", index, project)
+	var obj storage.Object
+	if obj, err = store.Head(ctx, index+"/"+project+tasks.ExtCompressedNDJSON); err != nil {
+		return
+	}
+	size = obj.Size
+	return
+}
+
+// ImportResult 单个项目的恢复结果
+type ImportResult struct {
+	// Documents 归档中的文档数，Kept 满足过滤条件并写入的文档数
+	Documents int64
+	Kept      int64
+	Skipped   int64
+	Retried   int64
+	// Failures 按错误类型统计的写入死信的文档数
+	Failures map[string]int64
+}
+
+// restoreRequest 保留归档中的记录，用于写入死信
+type restoreRequest struct {
+	*elastic.BulkIndexRequest
+	rec tasks.Record
+}
+
+// StorageImportToES 将归档写入目标索引，prg 为空时单独显示进度
+func StorageImportToES(ctx context.Context, store storage.Storage, opts RestoreOptions, target string, size int64, pm *tasks.ProjectManifest, prg logutil.Progress, clientES *elastic.Client, info cluster.Info) (res ImportResult, err error) {
+	index, project, mode := opts.Index, opts.Project, opts.Mode
+	title := fmt.Sprintf("从存储恢复索引: %s (%s) -> %s, 模式: %s", index, project, target, mode)
+	joblog.Printf(ctx, title)
+	var rc io.ReadCloser
+	if rc, err = store.Get(ctx, index+"/"+project+tasks.ExtCompressedNDJSON, 0, 0); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	if prg == nil {
+		prg = logutil.NewProgress(logutil.LoggerFunc(joblog.Printer(ctx)), title)
+	}
+	prg.SetTotal(size)
+
+	var r io.Reader = rc
+	var verifier *tasks.ManifestVerifier
+	if pm != nil {
+		verifier = tasks.NewManifestVerifier(pm)
+		r = io.TeeReader(rc, verifier)
+	}
+
+	cr := iocount.NewReader(r)
+	defer func() {
+		metrics.BytesDownloaded.With(index, project).Add(float64(cr.ReadCount()))
+	}()
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(cr); err != nil {
+		return
+	}
+	br := bufio.NewReader(zr)
+
+	var legacy, remapped int64
+
+	var dlw *deadLetterWriter
+	if opts.DeadLetter != "" {
+		dlw = newDeadLetterWriter(opts, store)
+		res.Failures = map[string]int64{}
+		defer func() {
+			if cErr := dlw.Close(joblog.Detach(ctx)); err == nil {
+				err = cErr
+			}
+		}()
+	}
+	// 解析失败的行在读取时写入死信，与 bulk 结果的处理并发
+	var dlLock sync.Mutex
+	deadLetter := func(dl DeadLetter, kind string) error {
+		dlLock.Lock()
+		defer dlLock.Unlock()
+		if err := dlw.Write(dl); err != nil {
+			return err
+		}
+		res.Failures[kind]++
+		return nil
+	}
+
+	restored := metrics.DocumentsRestored.With(index, project)
+	latency := metrics.BulkDuration.With(index)
+
+	bo := opts.Bulk
+	bo.Observe = func(d time.Duration) {
+		latency.Observe(d.Seconds())
+	}
+	pipeline := bulk.New(ctx, clientES, bo, func(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) (err error) {
+		var failed int
+		for _, item := range items {
+			if item.Status > 299 {
+				failed++
+				metrics.BulkItemFailures.With(index, project, strconv.Itoa(item.Status)).Inc()
+			}
+		}
+		restored.Add(float64(len(requests) - failed))
+		for i, item := range items {
+			if item.Status <= 299 {
+				continue
+			}
+			// 文档已经存在，或者已经存在版本更新的文档
+			if item.Status == http.StatusConflict && (mode == RestoreModeCreate || mode == RestoreModeExternalVersion) {
+				res.Skipped++
+				continue
+			}
+			buf, _ := json.MarshalIndent(item, "", "  ")
+			// fail 模式下文档已经存在时直接失败，不写入死信
+			if item.Status == http.StatusConflict && mode == RestoreModeFail {
+				err = fmt.Errorf("文档已经存在: %s", string(buf))
+				return
+			}
+			if dlw != nil {
+				if err = deadLetter(DeadLetter{
+					Record: requests[i].(*restoreRequest).rec,
+					Target: target,
+					Status: item.Status,
+					Error:  item.Error,
+				}, failureType(item)); err != nil {
+					return
+				}
+				continue
+			}
+			if item.Status == http.StatusConflict {
+				err = fmt.Errorf("文档已经存在: %s", string(buf))
+			} else if bulk.RetryableItem(item) {
+				err = fmt.Errorf("重试 %d 次后依然失败: %s", bo.Retries, string(buf))
+			} else {
+				err = fmt.Errorf("存在失败的索引请求: %s", string(buf))
+			}
+			return
+		}
+		return
+	})
+	defer func() {
+		res.Retried = pipeline.Retried()
+		metrics.BulkItemRetries.With(index, project).Add(float64(res.Retried))
+		if res.Retried > 0 {
+			joblog.Printf(ctx, "重试过的文档: %d", res.Retried)
+		}
+	}()
+	defer func() {
+		if cErr := pipeline.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	var buf []byte
+	for {
+		if buf, err = br.ReadBytes('\n'); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+
+		prg.SetCount(cr.ReadCount())
+
+		buf = bytes.TrimSpace(buf)
+
+		if len(buf) > 0 {
+			res.Documents++
+			var rec tasks.Record
+			if rec, err = tasks.ParseRecord(buf); err != nil {
+				if dlw == nil {
+					return
+				}
+				if err = deadLetter(DeadLetter{
+					Line:   string(buf),
+					Target: target,
+					Error:  &elastic.ErrorDetails{Type: FailureMalformed, Reason: err.Error()},
+				}, FailureMalformed); err != nil {
+					return
+				}
+				continue
+			}
+			if opts.Filter != nil && !opts.Filter.Match(rec.Source) {
+				continue
+			}
+			res.Kept++
+			// 旧版本的归档没有 _id，由 Elasticsearch 生成
+			req := elastic.NewBulkIndexRequest().Index(target).Doc(rec.Source)
+			if rec.ID != "" {
+				req.Id(rec.ID)
+			} else {
+				legacy++
+			}
+			if rec.Routing != "" {
+				req.Routing(rec.Routing)
+			}
+			switch mode {
+			case RestoreModeCreate, RestoreModeFail:
+				req.OpType("create")
+			case RestoreModeExternalVersion:
+				if rec.Version <= 0 {
+					err = errors.New("归档中缺少 _version，无法使用 " + RestoreModeExternalVersion + " 模式")
+					return
+				}
+				req.VersionType("external").Version(rec.Version)
+			}
+			// 支持 mapping type 的集群使用归档中的 _type，否则统一去掉
+			if typ := info.MappingType(); typ != "" {
+				if rec.Type != "" {
+					typ = rec.Type
+				}
+				req.Type(typ)
+			} else if rec.Type != "" && rec.Type != "_doc" {
+				remapped++
+			}
+			if err = restoreThrottle.Wait(ctx, len(buf)); err != nil {
+				return
+			}
+			if err = pipeline.Add(&restoreRequest{BulkIndexRequest: req, rec: rec}); err != nil {
+				return
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if err = pipeline.Close(); err != nil {
+		return
+	}
+
+	if opts.Filter != nil {
+		joblog.Printf(ctx, "过滤条件: 扫描 %d 个文档，保留 %d 个文档", res.Documents, res.Kept)
+	}
+	if res.Skipped > 0 {
+		joblog.Printf(ctx, "跳过已经存在的文档: %d", res.Skipped)
+	}
+	if len(res.Failures) > 0 {
+		joblog.Printf(ctx, "无法恢复的文档: %s", formatFailures(res.Failures))
+	}
+	if remapped > 0 {
+		joblog.Printf(ctx, "集群不支持 mapping type，忽略归档中的 _type: %d", remapped)
+	}
+	if legacy > 0 && mode != RestoreModeOverwrite {
+		joblog.Printf(ctx, "旧版本归档中的文档没有 _id，无法检测冲突: %d", legacy)
+	}
+
+	if verifier != nil {
+		if _, err = io.Copy(ioutil.Discard, cr); err != nil {
+			return
+		}
+		// 恢复前已经校验过，这里失败说明归档在恢复期间发生了变化
+		if err = verifier.Verify(res.Documents); err != nil {
+			err = fmt.Errorf("目标索引 %s 中的数据未通过校验: %s", target, err.Error())
+			return
+		}
+	}
+
+	return
+}
+
+// StorageVerify 读取归档并与描述文件校验，不写入 Elasticsearch
+func StorageVerify(ctx context.Context, store storage.Storage, index, project string) (docs int64, err error) {
+	var size int64
+	if size, err = StorageCheckFile(ctx, store, index, project); err != nil {
+		return
+	}
+	var pm *tasks.ProjectManifest
+	if pm, err = StorageCheckManifest(ctx, store, index, project, size); err != nil {
+		return
+	}
+	if pm == nil {
+		err = fmt.Errorf("没有找到描述文件，无法校验: %s/%s", index, project)
+		return
+	}
+	return storageVerifyArchive(ctx, store, index, project, size, pm)
+}
+
+// storageVerifyArchive 下载归档，校验 SHA-256 和文档数
+func storageVerifyArchive(ctx context.Context, store storage.Storage, index, project string, size int64, pm *tasks.ProjectManifest) (docs int64, err error) {
+	var rc io.ReadCloser
+	if rc, err = store.Get(ctx, index+"/"+project+tasks.ExtCompressedNDJSON, 0, 0); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	title := fmt.Sprintf("校验归档: %s/%s", index, project)
+	prg := logutil.NewProgress(logutil.LoggerFunc(joblog.Printer(ctx)), title)
+	prg.SetTotal(size)
+
+	verifier := tasks.NewManifestVerifier(pm)
+	cr := iocount.NewReader(io.TeeReader(rc, verifier))
+	defer func() {
+		metrics.BytesDownloaded.With(index, project).Add(float64(cr.ReadCount()))
+	}()
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(cr); err != nil {
+		return
+	}
+	br := bufio.NewReader(zr)
+	var buf []byte
+	for {
+		if buf, err = br.ReadBytes('\n'); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if len(bytes.TrimSpace(buf)) > 0 {
+			docs++
+		}
+		if docs%10000 == 0 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			prg.SetCount(cr.ReadCount())
+		}
+	}
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(ioutil.Discard, cr); err != nil {
+		return
+	}
+	if err = verifier.Verify(docs); err != nil {
+		return
+	}
+	joblog.Printf(ctx, "校验通过: %s/%s, 文档数 = %d", index, project, docs)
+	return
+}
+
+// VerifySelectors 校验匹配的所有归档，单个归档失败不影响其他归档
+func VerifySelectors(ctx context.Context, store storage.Storage, selectors string) (err error) {
+	var pairs [][2]string
+	if pairs, err = ResolveRestoreSelectors(ctx, store, selectors); err != nil {
+		return
+	}
+	var failed int
+	for _, pair := range pairs {
+		if _, err = StorageVerify(ctx, store, pair[0], pair[1]); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failed++
+			joblog.Printf(ctx, "校验失败: %s/%s: %s", pair[0], pair[1], err.Error())
+		}
+	}
+	err = nil
+	if failed > 0 {
+		err = fmt.Errorf("%d 个归档校验失败", failed)
+	}
+	return
+}
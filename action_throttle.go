@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/guoyk93/esbridge/ratelimit"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RestoreRateLimit 恢复时的速率限制，0 表示不限制
+type RestoreRateLimit struct {
+	DocumentsPerSecond float64 `yaml:"documents_per_second" json:"documents_per_second"`
+	// MBPerSecond 未压缩的数据量，单位 MB
+	MBPerSecond float64 `yaml:"mb_per_second" json:"mb_per_second"`
+}
+
+func (l RestoreRateLimit) Check() error {
+	if l.DocumentsPerSecond < 0 || l.MBPerSecond < 0 {
+		return errors.New("速率限制不能小于 0")
+	}
+	return nil
+}
+
+// RestoreThrottle 所有恢复任务共享的速率限制，可以在运行时修改
+type RestoreThrottle struct {
+	docs  *ratelimit.Limiter
+	bytes *ratelimit.Limiter
+}
+
+var restoreThrottle = &RestoreThrottle{
+	docs:  ratelimit.New(0),
+	bytes: ratelimit.New(0),
+}
+
+func (t *RestoreThrottle) Get() RestoreRateLimit {
+	return RestoreRateLimit{
+		DocumentsPerSecond: t.docs.Rate(),
+		MBPerSecond:        t.bytes.Rate() / 1024 / 1024,
+	}
+}
+
+func (t *RestoreThrottle) Set(l RestoreRateLimit) {
+	t.docs.SetRate(l.DocumentsPerSecond)
+	t.bytes.SetRate(l.MBPerSecond * 1024 * 1024)
+	log.Printf("恢复速率限制: %s", l.String())
+}
+
+// Wait 等待写入一个大小为 size 的文档
+func (t *RestoreThrottle) Wait(ctx context.Context, size int) (err error) {
+	if err = t.docs.WaitN(ctx, 1); err != nil {
+		return
+	}
+	return t.bytes.WaitN(ctx, int64(size))
+}
+
+func (l RestoreRateLimit) String() string {
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+// watchRateLimitReload 收到 SIGHUP 后重新读取配置文件中的速率限制，命令行中明确指定的参数依然优先
+func watchRateLimitReload() {
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGHUP)
+	for range chSig {
+		c, err := LoadConf(optConf)
+		if err != nil {
+			log.Printf("重新加载配置文件失败: %s", err.Error())
+			continue
+		}
+		var l RestoreRateLimit
+		if l, err = restoreRateLimit(c); err != nil {
+			log.Printf("重新加载配置文件失败: %s", err.Error())
+			continue
+		}
+		restoreThrottle.Set(l)
+	}
+}
+
+// handleRateLimit 查看和修改恢复时的速率限制
+func (s *apiServer) handleRateLimit(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, restoreThrottle.Get())
+	case http.MethodPut, http.MethodPost:
+		var l RestoreRateLimit
+		if err := json.NewDecoder(req.Body).Decode(&l); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err := l.Check(); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		restoreThrottle.Set(l)
+		writeJSON(rw, http.StatusOK, restoreThrottle.Get())
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, errors.New("不支持的请求方法"))
+	}
+}
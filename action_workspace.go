@@ -4,14 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/guoyk93/esbridge/storage"
 	"github.com/guoyk93/esbridge/tasks"
 	"github.com/guoyk93/logutil"
-	"github.com/tencentyun/cos-go-sdk-v5"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 )
 
@@ -34,8 +33,8 @@ func WorkspaceSetup(dir string) (err error) {
 	return
 }
 
-func WorkspaceUploadToCOS(dir string, clientCOS *cos.Client, index string) (err error) {
-	title := fmt.Sprintf("导出索引到腾讯云存储: %s", index)
+func WorkspaceUploadToStorage(dir string, store storage.Storage, index string) (err error) {
+	title := fmt.Sprintf("导出索引到存储: %s", index)
 	log.Println(title)
 
 	var fis []os.FileInfo
@@ -54,13 +53,7 @@ func WorkspaceUploadToCOS(dir string, clientCOS *cos.Client, index string) (err
 			err = fmt.Errorf("发现未知文件: %s", fi.Name())
 			return
 		}
-		if _, _, err = clientCOS.Object.Upload(context.Background(), index+"/"+fi.Name(), filepath.Join(dir, fi.Name()), &cos.MultiUploadOptions{
-			PartSize:       1000,
-			ThreadPoolSize: runtime.NumCPU(),
-			OptIni: &cos.InitiateMultipartUploadOptions{
-				ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosStorageClass: "STANDARD_IA"},
-			},
-		}); err != nil {
+		if err = store.Put(context.Background(), index+"/"+fi.Name(), filepath.Join(dir, fi.Name()), storage.PutOptions{}); err != nil {
 			return
 		}
 
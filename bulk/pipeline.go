@@ -0,0 +1,298 @@
+package bulk
+
+import (
+	"context"
+	"fmt"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/olivere/elastic"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultWorkers       = 2
+	DefaultActions       = 4000
+	DefaultBytes         = 10 * 1024 * 1024
+	DefaultFlushInterval = 5 * time.Second
+)
+
+type Options struct {
+	// Workers 同时进行的 bulk 请求数
+	Workers int
+	// Actions 单个 bulk 请求的最大文档数
+	Actions int
+	// Bytes 单个 bulk 请求的最大字节数
+	Bytes int64
+	// FlushInterval 未满的批次最长等待时间，0 表示不按时间发送
+	FlushInterval time.Duration
+	// Retries 可以重试的失败最多重试的次数，包括单个文档被拒绝和整个请求失败
+	Retries int
+	// Backoff 和 MaxBackoff 第一次重试前的等待时间和最长等待时间
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Observe 每次 bulk 请求完成后调用，参数为请求耗时
+	Observe func(d time.Duration)
+}
+
+// DefaultOptions 默认的批次设置
+func DefaultOptions() Options {
+	return Options{
+		Workers:       DefaultWorkers,
+		Actions:       DefaultActions,
+		Bytes:         DefaultBytes,
+		FlushInterval: DefaultFlushInterval,
+		Retries:       DefaultRetries,
+		Backoff:       DefaultBackoff,
+		MaxBackoff:    DefaultMaxBackoff,
+	}
+}
+
+// Handler 处理一个批次重试之后的结果，items 与 requests 按顺序一一对应，handler 的调用是串行的
+type Handler func(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) error
+
+// Pipeline 将文档按数量、大小或者时间分批，由多个 worker 并发发送 bulk 请求
+//
+// Add 和 Close 只能在同一个 goroutine 中调用，Close 之后不能再调用 Add，任意一个批次出错后，之后的 Add 和 Close 返回该错误
+type Pipeline struct {
+	Options
+
+	client  *elastic.Client
+	handler Handler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	pending []elastic.BulkableRequest
+	size    int64
+
+	batches chan []elastic.BulkableRequest
+	stop    chan struct{}
+	ticker  sync.WaitGroup
+	workers sync.WaitGroup
+
+	hLock sync.Mutex
+
+	retried int64
+
+	errLock sync.Mutex
+	err     error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func New(ctx context.Context, client *elastic.Client, opts Options, handler Handler) *Pipeline {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.Actions < 1 {
+		opts.Actions = DefaultActions
+	}
+	if opts.Bytes < 1 {
+		opts.Bytes = DefaultBytes
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = opts.Backoff
+	}
+	p := &Pipeline{
+		Options: opts,
+		client:  client,
+		handler: handler,
+		batches: make(chan []elastic.BulkableRequest),
+		stop:    make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	for i := 0; i < opts.Workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	if opts.FlushInterval > 0 {
+		p.ticker.Add(1)
+		go p.tick()
+	}
+	return p
+}
+
+func (p *Pipeline) fail(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cancel()
+}
+
+// Err 第一个出错的批次的错误，或者 ctx 被取消的错误
+func (p *Pipeline) Err() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+func (p *Pipeline) work() {
+	defer p.workers.Done()
+	for requests := range p.batches {
+		if p.ctx.Err() != nil {
+			continue
+		}
+		if err := p.send(requests); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// Retried 被重试过的文档数
+func (p *Pipeline) Retried() int64 {
+	return atomic.LoadInt64(&p.retried)
+}
+
+// send 发送一个批次，重试可以重试的失败，之后将最终结果交给 handler
+func (p *Pipeline) send(requests []elastic.BulkableRequest) (err error) {
+	items := make([]*elastic.BulkResponseItem, len(requests))
+	retried := make([]bool, len(requests))
+	pending := make([]int, len(requests))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 0; ; attempt++ {
+		batch := make([]elastic.BulkableRequest, 0, len(pending))
+		for _, i := range pending {
+			batch = append(batch, requests[i])
+		}
+		start := time.Now()
+		var res *elastic.BulkResponse
+		res, err = p.client.Bulk().Add(batch...).Do(p.ctx)
+		if p.Observe != nil {
+			p.Observe(time.Since(start))
+		}
+
+		var next []int
+		if err != nil {
+			if attempt >= p.Retries || !RetryableError(err) {
+				return
+			}
+			joblog.Printf(p.ctx, "bulk 请求失败: %s", err.Error())
+			next = pending
+		} else {
+			if len(res.Items) != len(batch) {
+				err = fmt.Errorf("bulk 响应数量不一致: %d != %d", len(res.Items), len(batch))
+				return
+			}
+			for n, m := range res.Items {
+				i := pending[n]
+				for _, item := range m {
+					items[i] = item
+				}
+				if attempt < p.Retries && RetryableItem(items[i]) {
+					next = append(next, i)
+				}
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		for _, i := range next {
+			if !retried[i] {
+				retried[i] = true
+				atomic.AddInt64(&p.retried, 1)
+			}
+		}
+		d := backoff(p.Backoff, p.MaxBackoff, attempt)
+		joblog.Printf(p.ctx, "%d 个文档写入失败，%s 后第 %d 次重试", len(next), d.Round(time.Millisecond), attempt+1)
+		if err = sleep(p.ctx, d); err != nil {
+			return
+		}
+		pending = next
+	}
+
+	p.hLock.Lock()
+	defer p.hLock.Unlock()
+	return p.handler(p.ctx, requests, items)
+}
+
+func (p *Pipeline) tick() {
+	defer p.ticker.Done()
+	t := time.NewTicker(p.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.ctx.Done():
+			return
+		case <-t.C:
+			if err := p.dispatch(p.take()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// take 取出当前的批次
+func (p *Pipeline) take() (requests []elastic.BulkableRequest) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	requests, p.pending, p.size = p.pending, nil, 0
+	return
+}
+
+func (p *Pipeline) dispatch(requests []elastic.BulkableRequest) error {
+	if len(requests) == 0 {
+		return nil
+	}
+	select {
+	case p.batches <- requests:
+		return nil
+	case <-p.ctx.Done():
+		return p.Err()
+	}
+}
+
+// Add 添加一个请求，批次已满时等待空闲的 worker
+func (p *Pipeline) Add(req elastic.BulkableRequest) (err error) {
+	if err = p.Err(); err != nil {
+		return
+	}
+	var lines []string
+	if lines, err = req.Source(); err != nil {
+		return
+	}
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	var full []elastic.BulkableRequest
+	p.lock.Lock()
+	p.pending = append(p.pending, req)
+	p.size += size
+	if len(p.pending) >= p.Actions || p.size >= p.Bytes {
+		full, p.pending, p.size = p.pending, nil, 0
+	}
+	p.lock.Unlock()
+	return p.dispatch(full)
+}
+
+// Close 发送剩余的文档，并等待所有请求完成，可以重复调用
+func (p *Pipeline) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.ticker.Wait()
+		err := p.dispatch(p.take())
+		close(p.batches)
+		p.workers.Wait()
+		if err == nil {
+			err = p.Err()
+		}
+		p.cancel()
+		p.closeErr = err
+	})
+	return p.closeErr
+}
@@ -0,0 +1,203 @@
+package bulk
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bulkServer 模拟 _bulk 接口，记录每个批次的文档，status 返回第 call 次请求中文档的状态，call 从 0 开始
+type bulkServer struct {
+	lock     sync.Mutex
+	batches  [][]int
+	inFlight int32
+	maxIn    int32
+	delay    time.Duration
+	status   func(call int, doc int) int
+	// reject 前几次请求直接返回 429
+	reject int
+}
+
+func (s *bulkServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		m := atomic.LoadInt32(&s.maxIn)
+		if n <= m || atomic.CompareAndSwapInt32(&s.maxIn, m, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	var docs []int
+	sc := bufio.NewScanner(req.Body)
+	for i := 0; sc.Scan(); i++ {
+		if i%2 == 1 {
+			var doc struct{ N int }
+			_ = json.Unmarshal(sc.Bytes(), &doc)
+			docs = append(docs, doc.N)
+		}
+	}
+	s.lock.Lock()
+	call := len(s.batches)
+	s.batches = append(s.batches, docs)
+	s.lock.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	if call < s.reject {
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"status": 429, "error": map[string]interface{}{"type": "es_rejected_execution_exception"}})
+		return
+	}
+	var items []map[string]interface{}
+	var errs bool
+	for _, doc := range docs {
+		item := map[string]interface{}{"_index": "a", "_id": strconv.Itoa(doc), "status": 201}
+		if s.status != nil {
+			if status := s.status(call, doc); status != 201 {
+				errs = true
+				item["status"] = status
+				item["error"] = map[string]interface{}{"type": "mapper_parsing_exception"}
+				if status == 429 {
+					item["error"] = map[string]interface{}{"type": "es_rejected_execution_exception"}
+				}
+			}
+		}
+		items = append(items, map[string]interface{}{"index": item})
+	}
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{"took": 1, "errors": errs, "items": items})
+}
+
+func (s *bulkServer) sizes() (out []int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, b := range s.batches {
+		out = append(out, len(b))
+	}
+	return
+}
+
+func newTestClient(t *testing.T, s *bulkServer) (*elastic.Client, func()) {
+	ts := httptest.NewServer(s)
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	assert.NoError(t, err)
+	return client, ts.Close
+}
+
+func newTestRequest(i int) elastic.BulkableRequest {
+	return elastic.NewBulkIndexRequest().Index("a").Type("_doc").Id(strconv.Itoa(i)).Doc(json.RawMessage(`{"n":` + strconv.Itoa(i) + `}`))
+}
+
+func nopHandler(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) error {
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	s := &bulkServer{delay: 20 * time.Millisecond}
+	client, done := newTestClient(t, s)
+	defer done()
+
+	var handled int
+	p := New(context.Background(), client, Options{Workers: 3, Actions: 10, FlushInterval: time.Hour}, func(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) error {
+		assert.Equal(t, len(requests), len(items))
+		handled += len(requests)
+		return nil
+	})
+	for i := 0; i < 95; i++ {
+		assert.NoError(t, p.Add(newTestRequest(i)))
+	}
+	assert.NoError(t, p.Close())
+	assert.Equal(t, 95, handled)
+	assert.Len(t, s.batches, 10)
+	assert.True(t, s.maxIn > 1)
+}
+
+func TestPipelineBytesAndInterval(t *testing.T) {
+	s := &bulkServer{}
+	client, done := newTestClient(t, s)
+	defer done()
+
+	// 每个请求约 60 字节
+	p := New(context.Background(), client, Options{Workers: 1, Actions: 1000, Bytes: 150}, nopHandler)
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, p.Add(newTestRequest(i)))
+	}
+	assert.NoError(t, p.Close())
+	assert.Equal(t, []int{3, 3}, s.sizes())
+
+	s.batches = nil
+	p = New(context.Background(), client, Options{Workers: 1, Actions: 1000, FlushInterval: 10 * time.Millisecond}, nopHandler)
+	assert.NoError(t, p.Add(newTestRequest(0)))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []int{1}, s.sizes())
+	assert.NoError(t, p.Close())
+}
+
+func TestPipelineError(t *testing.T) {
+	s := &bulkServer{status: func(call int, doc int) int { return 400 }}
+	client, done := newTestClient(t, s)
+	defer done()
+
+	errFailed := errors.New("failed")
+	p := New(context.Background(), client, Options{Workers: 2, Actions: 2, Retries: 3}, func(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) error {
+		for _, item := range items {
+			if item.Status == 400 {
+				return errFailed
+			}
+		}
+		return nil
+	})
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = p.Add(newTestRequest(i))
+	}
+	assert.Equal(t, errFailed, err)
+	assert.Equal(t, errFailed, p.Close())
+	assert.Equal(t, int64(0), p.Retried())
+}
+
+func TestPipelineRetry(t *testing.T) {
+	// 第一次请求整体被拒绝，之后奇数文档被拒绝两次，文档 3 一直被拒绝
+	s := &bulkServer{reject: 1, status: func(call int, doc int) int {
+		if doc == 3 || (doc%2 == 1 && call < 3) {
+			return 429
+		}
+		return 201
+	}}
+	client, done := newTestClient(t, s)
+	defer done()
+
+	var statuses = map[string]int{}
+	p := New(context.Background(), client, Options{Workers: 1, Actions: 6, Retries: 4, Backoff: time.Millisecond}, func(ctx context.Context, requests []elastic.BulkableRequest, items []*elastic.BulkResponseItem) error {
+		for _, item := range items {
+			statuses[item.Id] = item.Status
+		}
+		return nil
+	})
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, p.Add(newTestRequest(i)))
+	}
+	assert.NoError(t, p.Close())
+	assert.Equal(t, map[string]int{"0": 201, "1": 201, "2": 201, "3": 429, "4": 201, "5": 201}, statuses)
+	assert.Equal(t, int64(6), p.Retried())
+	assert.Equal(t, []int{6, 6, 3, 3, 1}, s.sizes())
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoff(time.Second, 10*time.Second, attempt)
+		max := time.Second << uint(attempt)
+		if max > 10*time.Second {
+			max = 10 * time.Second
+		}
+		assert.True(t, d >= max/2 && d <= max, d.String())
+	}
+}
@@ -0,0 +1,79 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"github.com/olivere/elastic"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultRetries    = 5
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// retryableStatus 集群繁忙或者暂时不可用，稍后重试可能成功
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryableItem 判断失败的文档是否可以重试，例如 es_rejected_execution_exception
+func RetryableItem(item *elastic.BulkResponseItem) bool {
+	if item == nil || item.Status < 300 {
+		return false
+	}
+	if item.Error != nil && item.Error.Type == "es_rejected_execution_exception" {
+		return true
+	}
+	return retryableStatus(item.Status)
+}
+
+// RetryableError 判断整个 bulk 请求的错误是否可以重试，例如连接失败或者 429
+func RetryableError(err error) bool {
+	if err == nil || elastic.IsContextErr(err) {
+		return false
+	}
+	if elastic.IsConnErr(err) || elastic.IsTimeout(err) {
+		return true
+	}
+	var e *elastic.Error
+	if errors.As(err, &e) {
+		return retryableStatus(e.Status)
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// backoff 第 attempt 次重试前的等待时间，指数增长，并在后一半随机抖动
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
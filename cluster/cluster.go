@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+// Info 集群的基本信息，来自 GET /
+type Info struct {
+	Distribution string
+	Version      string
+	Major        int
+	Minor        int
+	Patch        int
+	ClusterName  string
+	ClusterUUID  string
+}
+
+func Detect(ctx context.Context, client *elastic.Client) (info Info, err error) {
+	var res *elastic.Response
+	if res, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/",
+	}); err != nil {
+		return
+	}
+	var body struct {
+		ClusterName string `json:"cluster_name"`
+		ClusterUUID string `json:"cluster_uuid"`
+		Version     struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.Unmarshal(res.Body, &body); err != nil {
+		return
+	}
+	info = Info{
+		Distribution: DistributionElasticsearch,
+		Version:      body.Version.Number,
+		ClusterName:  body.ClusterName,
+		ClusterUUID:  body.ClusterUUID,
+	}
+	if body.Version.Distribution == DistributionOpenSearch {
+		info.Distribution = DistributionOpenSearch
+	}
+	if info.Major, info.Minor, info.Patch, err = parseVersion(body.Version.Number); err != nil {
+		return
+	}
+	return
+}
+
+func parseVersion(v string) (major, minor, patch int, err error) {
+	// 去除 -SNAPSHOT 等后缀
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	splits := strings.Split(v, ".")
+	if len(splits) < 2 {
+		err = fmt.Errorf("无法识别的版本号: %s", v)
+		return
+	}
+	nums := make([]int, 3)
+	for i := 0; i < len(splits) && i < 3; i++ {
+		if nums[i], err = strconv.Atoi(splits[i]); err != nil {
+			err = fmt.Errorf("无法识别的版本号: %s", v)
+			return
+		}
+	}
+	major, minor, patch = nums[0], nums[1], nums[2]
+	return
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s %s (%s)", i.Distribution, i.Version, i.ClusterName)
+}
+
+func (i Info) IsOpenSearch() bool {
+	return i.Distribution == DistributionOpenSearch
+}
+
+func (i Info) AtLeast(major, minor int) bool {
+	return i.Major > major || (i.Major == major && i.Minor >= minor)
+}
+
+// SupportsPIT 是否支持 point in time 搜索，Elasticsearch 7.12 起支持 _shard_doc 排序
+func (i Info) SupportsPIT() bool {
+	if i.IsOpenSearch() {
+		return i.AtLeast(2, 4)
+	}
+	return i.AtLeast(7, 12)
+}
+
+// Check 检查集群版本是否受支持，支持 Elasticsearch 6.x - 8.x 和 OpenSearch 1.x - 2.x
+func (i Info) Check() error {
+	if i.IsOpenSearch() {
+		if i.Major < 1 || i.Major > 2 {
+			return fmt.Errorf("不支持的 OpenSearch 版本: %s", i.Version)
+		}
+		return nil
+	}
+	if i.Major < 6 || i.Major > 8 {
+		return fmt.Errorf("不支持的 Elasticsearch 版本: %s", i.Version)
+	}
+	return nil
+}
+
+// Typeless 是否不再使用 mapping type，Elasticsearch 7.x 起和 OpenSearch 均不使用
+func (i Info) Typeless() bool {
+	return i.IsOpenSearch() || i.Major >= 7
+}
+
+// MappingType 请求中使用的 mapping type，不使用时为空
+func (i Info) MappingType() string {
+	if i.Typeless() {
+		return ""
+	}
+	return "_doc"
+}
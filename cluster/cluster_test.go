@@ -0,0 +1,38 @@
+package cluster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	major, minor, patch, err := parseVersion("7.17.3")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{7, 17, 3}, []int{major, minor, patch})
+
+	major, minor, patch, err = parseVersion("8.0.0-SNAPSHOT")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{8, 0, 0}, []int{major, minor, patch})
+
+	_, _, _, err = parseVersion("unknown")
+	assert.Error(t, err)
+}
+
+func TestInfo(t *testing.T) {
+	es6 := Info{Distribution: DistributionElasticsearch, Major: 6, Minor: 8}
+	es7 := Info{Distribution: DistributionElasticsearch, Major: 7, Minor: 17}
+	os1 := Info{Distribution: DistributionOpenSearch, Major: 1, Minor: 3}
+	os2 := Info{Distribution: DistributionOpenSearch, Major: 2, Minor: 11}
+
+	assert.Equal(t, "_doc", es6.MappingType())
+	assert.Equal(t, "", es7.MappingType())
+	assert.Equal(t, "", os1.MappingType())
+
+	assert.False(t, es6.SupportsPIT())
+	assert.True(t, es7.SupportsPIT())
+	assert.False(t, os1.SupportsPIT())
+	assert.True(t, os2.SupportsPIT())
+
+	assert.NoError(t, os2.Check())
+	assert.Error(t, Info{Distribution: DistributionElasticsearch, Major: 5}.Check())
+}
@@ -2,9 +2,22 @@ package main
 
 import (
 	"errors"
+	"github.com/guoyk93/esbridge/bulk"
+	"github.com/guoyk93/esbridge/daemon"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/guoyk93/esbridge/tasks"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"log"
+	"path"
 	"strings"
+	"time"
+)
+
+const (
+	StorageCOS   = "cos"
+	StorageS3    = "s3"
+	StorageLocal = "local"
 )
 
 type Conf struct {
@@ -15,11 +28,191 @@ type Conf struct {
 	Elasticsearch struct {
 		URL string `yaml:"url"`
 	} `yaml:"elasticsearch"`
-	COS struct {
-		URL       string `yaml:"url"`
-		SecretID  string `yaml:"secret_id"`
-		SecretKey string `yaml:"secret_key"`
+	Storage string `yaml:"storage"`
+	COS     struct {
+		URL          string `yaml:"url"`
+		SecretID     string `yaml:"secret_id"`
+		SecretKey    string `yaml:"secret_key"`
+		StorageClass string `yaml:"storage_class"`
 	} `yaml:"cos"`
+	S3 struct {
+		Endpoint        string `yaml:"endpoint"`
+		Region          string `yaml:"region"`
+		Bucket          string `yaml:"bucket"`
+		AccessKeyID     string `yaml:"access_key_id"`
+		SecretAccessKey string `yaml:"secret_access_key"`
+		PathStyle       bool   `yaml:"path_style"`
+		StorageClass    string `yaml:"storage_class"`
+		PartSize        int64  `yaml:"part_size"`
+	} `yaml:"s3"`
+	Local struct {
+		Dir string `yaml:"dir"`
+	} `yaml:"local"`
+	API struct {
+		// Enabled 在 pprof 监听地址上提供任务接口，仅在 -serve 时有效
+		Enabled bool   `yaml:"enabled"`
+		Token   string `yaml:"token"`
+		// MaxJobs 同时运行的任务数
+		MaxJobs int `yaml:"max_jobs"`
+	} `yaml:"api"`
+	Daemon struct {
+		// History 任务历史文件，默认为工作目录下的 _history.json
+		History  string          `yaml:"history"`
+		Policies []daemon.Policy `yaml:"policies"`
+	} `yaml:"daemon"`
+	Restore struct {
+		// Default 默认使用的模板
+		Default   string                     `yaml:"default"`
+		Templates map[string]RestoreTemplate `yaml:"templates"`
+		// Indices 按索引名匹配模板，使用第一个匹配的规则
+		Indices []struct {
+			Pattern  string `yaml:"pattern"`
+			Template string `yaml:"template"`
+		} `yaml:"indices"`
+		Bulk RestoreBulk `yaml:"bulk"`
+		// DeadLetter 无法恢复的文档的处理方式，可选 local, storage，为空时恢复失败
+		DeadLetter string `yaml:"dead_letter"`
+		// RateLimit 所有恢复任务共享的速率限制，收到 SIGHUP 后重新读取
+		RateLimit RestoreRateLimit `yaml:"rate_limit"`
+	} `yaml:"restore"`
+}
+
+// RestoreBulk 恢复时写入数据的批次设置，为空时使用默认值，命令行参数优先
+type RestoreBulk struct {
+	// Workers 同时进行的 bulk 请求数
+	Workers int `yaml:"workers"`
+	// Actions 单个 bulk 请求的最大文档数
+	Actions int `yaml:"actions"`
+	// Size 单个 bulk 请求的最大大小，单位 MB
+	Size int64 `yaml:"size"`
+	// FlushInterval 未满的批次最长等待时间，例如 5s
+	FlushInterval string `yaml:"flush_interval"`
+	// Retries 被拒绝或者暂时失败的文档最多重试的次数，0 表示不重试
+	Retries *int `yaml:"retries"`
+	// Backoff 和 MaxBackoff 第一次重试前的等待时间和最长等待时间，例如 1s 和 1m
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"max_backoff"`
+}
+
+// Options 在默认设置的基础上应用配置
+func (b RestoreBulk) Options() (opts bulk.Options, err error) {
+	opts = bulk.DefaultOptions()
+	if b.Workers > 0 {
+		opts.Workers = b.Workers
+	}
+	if b.Actions > 0 {
+		opts.Actions = b.Actions
+	}
+	if b.Size > 0 {
+		opts.Bytes = b.Size * 1024 * 1024
+	}
+	if b.FlushInterval != "" {
+		if opts.FlushInterval, err = time.ParseDuration(b.FlushInterval); err != nil {
+			err = errors.New("无效的 restore.bulk.flush_interval: " + b.FlushInterval)
+			return
+		}
+	}
+	if b.Retries != nil {
+		opts.Retries = *b.Retries
+	}
+	if b.Backoff != "" {
+		if opts.Backoff, err = time.ParseDuration(b.Backoff); err != nil {
+			err = errors.New("无效的 restore.bulk.backoff: " + b.Backoff)
+			return
+		}
+	}
+	if b.MaxBackoff != "" {
+		if opts.MaxBackoff, err = time.ParseDuration(b.MaxBackoff); err != nil {
+			err = errors.New("无效的 restore.bulk.max_backoff: " + b.MaxBackoff)
+			return
+		}
+	}
+	return
+}
+
+// RestoreTemplate 恢复时新建索引和写入数据时使用的设置
+type RestoreTemplate struct {
+	// Shards 和 Replicas 为空时使用归档中的设置
+	Shards   *int `yaml:"shards"`
+	Replicas *int `yaml:"replicas"`
+	// Allocation index.routing.allocation 下的设置，例如 require.disktype: hdd
+	Allocation map[string]string `yaml:"allocation"`
+	// RefreshInterval 恢复完成后的 refresh_interval
+	RefreshInterval string `yaml:"refresh_interval"`
+	// RecoveryRefreshInterval 写入数据期间的 refresh_interval
+	RecoveryRefreshInterval string `yaml:"recovery_refresh_interval"`
+	// Target 目标索引名称模板，支持 {index} 和 {project}
+	Target string `yaml:"target"`
+	// Alias 目标索引与原索引不同时创建的别名，为空时使用默认的别名
+	Alias string `yaml:"alias"`
+	// NoAlias 不创建别名
+	NoAlias bool `yaml:"no_alias"`
+}
+
+// Overrides 新建索引时覆盖归档中的设置
+func (t RestoreTemplate) Overrides() tasks.IndexMetaOverrides {
+	o := tasks.IndexMetaOverrides{Shards: -1, Replicas: -1, Allocation: t.Allocation}
+	if t.Shards != nil {
+		o.Shards = *t.Shards
+	}
+	if t.Replicas != nil {
+		o.Replicas = *t.Replicas
+	}
+	return o
+}
+
+// DefaultRestoreTemplate 没有配置模板时使用的设置
+func DefaultRestoreTemplate() RestoreTemplate {
+	replicas := 0
+	return RestoreTemplate{
+		Replicas:                &replicas,
+		Allocation:              map[string]string{"require.disktype": "hdd"},
+		RefreshInterval:         "10s",
+		RecoveryRefreshInterval: "1m",
+		Target:                  DefaultRestoreTarget,
+		Alias:                   DefaultRestoreAlias,
+	}
+}
+
+// ResolveRestoreTemplate 获取恢复索引使用的模板，name 为空时按索引名匹配，之后使用默认模板
+func ResolveRestoreTemplate(conf Conf, name string, index string) (tpl RestoreTemplate, err error) {
+	if name == "" {
+		for _, item := range conf.Restore.Indices {
+			if ok, _ := path.Match(item.Pattern, index); ok {
+				name = item.Template
+				break
+			}
+		}
+	}
+	if name == "" {
+		name = conf.Restore.Default
+	}
+	if name == "" {
+		tpl = DefaultRestoreTemplate()
+		return
+	}
+	var ok bool
+	if tpl, ok = conf.Restore.Templates[name]; !ok {
+		err = errors.New("未知的恢复模板: " + name)
+		return
+	}
+	log.Printf("使用恢复模板: %s", name)
+	def := DefaultRestoreTemplate()
+	if tpl.RefreshInterval == "" {
+		tpl.RefreshInterval = def.RefreshInterval
+	}
+	if tpl.RecoveryRefreshInterval == "" {
+		tpl.RecoveryRefreshInterval = def.RecoveryRefreshInterval
+	}
+	if tpl.Target == "" {
+		tpl.Target = def.Target
+	}
+	if tpl.NoAlias {
+		tpl.Alias = ""
+	} else if tpl.Alias == "" {
+		tpl.Alias = def.Alias
+	}
+	return
 }
 
 func checkFieldStr(str *string, name string) error {
@@ -44,17 +237,105 @@ func LoadConf(file string) (conf Conf, err error) {
 	if err = checkFieldStr(&conf.Elasticsearch.URL, "elasticsearch.url"); err != nil {
 		return
 	}
-	if err = checkFieldStr(&conf.COS.URL, "cos.url"); err != nil {
+	conf.Storage = strings.TrimSpace(conf.Storage)
+	if conf.Storage == "" {
+		conf.Storage = StorageCOS
+	}
+	switch conf.Storage {
+	case StorageCOS:
+		if err = checkFieldStr(&conf.COS.URL, "cos.url"); err != nil {
+			return
+		}
+		if err = checkFieldStr(&conf.COS.SecretID, "cos.secret_id"); err != nil {
+			return
+		}
+		if err = checkFieldStr(&conf.COS.SecretKey, "cos.secret_key"); err != nil {
+			return
+		}
+	case StorageS3:
+		if err = checkFieldStr(&conf.S3.Endpoint, "s3.endpoint"); err != nil {
+			return
+		}
+		if err = checkFieldStr(&conf.S3.Bucket, "s3.bucket"); err != nil {
+			return
+		}
+		if err = checkFieldStr(&conf.S3.AccessKeyID, "s3.access_key_id"); err != nil {
+			return
+		}
+		if err = checkFieldStr(&conf.S3.SecretAccessKey, "s3.secret_access_key"); err != nil {
+			return
+		}
+	case StorageLocal:
+		if err = checkFieldStr(&conf.Local.Dir, "local.dir"); err != nil {
+			return
+		}
+	default:
+		err = errors.New("未知的存储类型: " + conf.Storage)
 		return
 	}
-	if err = checkFieldStr(&conf.COS.SecretID, "cos.secret_id"); err != nil {
+	if err = checkFieldStr(&conf.PProf.Bind, "pprof.bind"); err != nil {
 		return
 	}
-	if err = checkFieldStr(&conf.COS.SecretKey, "cos.secret_key"); err != nil {
+	// 任务接口可以删除索引，不允许匿名访问
+	if conf.API.Enabled {
+		if err = checkFieldStr(&conf.API.Token, "api.token"); err != nil {
+			return
+		}
+	}
+	if conf.Restore.Default != "" {
+		if _, ok := conf.Restore.Templates[conf.Restore.Default]; !ok {
+			err = errors.New("未知的恢复模板: restore.default = " + conf.Restore.Default)
+			return
+		}
+	}
+	for _, item := range conf.Restore.Indices {
+		if _, err = path.Match(item.Pattern, ""); err != nil {
+			err = errors.New("无效的索引匹配规则: " + item.Pattern)
+			return
+		}
+		if _, ok := conf.Restore.Templates[item.Template]; !ok {
+			err = errors.New("未知的恢复模板: " + item.Template)
+			return
+		}
+	}
+	if _, err = conf.Restore.Bulk.Options(); err != nil {
 		return
 	}
-	if err = checkFieldStr(&conf.PProf.Bind, "pprof.bind"); err != nil {
+	conf.Restore.DeadLetter = strings.TrimSpace(conf.Restore.DeadLetter)
+	if err = checkDeadLetter(conf.Restore.DeadLetter); err != nil {
+		return
+	}
+	if err = conf.Restore.RateLimit.Check(); err != nil {
 		return
 	}
 	return
 }
+
+func CreateStorage(conf Conf) (storage.Storage, error) {
+	switch conf.Storage {
+	case StorageCOS:
+		return storage.NewCOS(storage.COSOptions{
+			URL:          conf.COS.URL,
+			SecretID:     conf.COS.SecretID,
+			SecretKey:    conf.COS.SecretKey,
+			StorageClass: conf.COS.StorageClass,
+		})
+	case StorageS3:
+		return storage.NewS3(storage.S3Options{
+			Endpoint:        conf.S3.Endpoint,
+			Region:          conf.S3.Region,
+			Bucket:          conf.S3.Bucket,
+			AccessKeyID:     conf.S3.AccessKeyID,
+			SecretAccessKey: conf.S3.SecretAccessKey,
+			PathStyle:       conf.S3.PathStyle,
+			StorageClass:    conf.S3.StorageClass,
+			PartSize:        conf.S3.PartSize,
+		})
+	case StorageLocal:
+		return storage.NewLocal(storage.LocalOptions{
+			Dir: conf.Local.Dir,
+		})
+	default:
+		return nil, errors.New("未知的存储类型: " + conf.Storage)
+	}
+}
@@ -0,0 +1,288 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/schedule"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning     = "running"
+	JobSucceeded   = "succeeded"
+	JobFailed      = "failed"
+	JobInterrupted = "interrupted"
+
+	// maxJobs 历史记录中保留的任务数
+	maxJobs = 500
+)
+
+// Policy 归档策略
+type Policy struct {
+	Name    string `yaml:"name" json:"name"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	// OlderThan 只迁移早于指定天数的索引
+	OlderThan int `yaml:"older_than" json:"older_than"`
+	// Schedule cron 表达式
+	Schedule     string `yaml:"schedule" json:"schedule"`
+	StorageClass string `yaml:"storage_class" json:"storage_class,omitempty"`
+	// Delete 迁移完成后删除索引，默认为 true
+	Delete      *bool  `yaml:"delete" json:"delete,omitempty"`
+	DateLayout  string `yaml:"date_layout" json:"date_layout,omitempty"`
+	Concurrency int    `yaml:"concurrency" json:"concurrency,omitempty"`
+}
+
+func (p Policy) ShouldDelete() bool {
+	return p.Delete == nil || *p.Delete
+}
+
+type Job struct {
+	ID          string     `json:"id"`
+	Policy      string     `json:"policy"`
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Status      string     `json:"status"`
+	// CatchUp 重启后补执行的任务
+	CatchUp bool     `json:"catch_up,omitempty"`
+	Indices []string `json:"indices,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// History 任务历史，保存在本地文件中
+type History struct {
+	Jobs []Job `json:"jobs"`
+	// LastScheduled 每个策略最后一次执行对应的计划时间
+	LastScheduled map[string]time.Time `json:"last_scheduled"`
+}
+
+// RunFunc 执行一次策略，迁移的索引记录在 job.Indices 中
+type RunFunc func(ctx context.Context, p Policy, job *Job) error
+
+type Daemon struct {
+	lock      sync.Mutex
+	policies  []Policy
+	schedules map[string]schedule.Schedule
+	file      string
+	history   History
+	run       RunFunc
+}
+
+func New(policies []Policy, file string, run RunFunc) (d *Daemon, err error) {
+	if len(policies) == 0 {
+		err = errors.New("没有配置归档策略")
+		return
+	}
+	d = &Daemon{
+		policies:  policies,
+		schedules: map[string]schedule.Schedule{},
+		file:      file,
+		run:       run,
+	}
+	for _, p := range policies {
+		if p.Name == "" || p.Pattern == "" {
+			err = errors.New("归档策略缺少 name 或者 pattern")
+			return
+		}
+		// older_than 为 0 时会选中正在写入的索引并删除
+		if p.OlderThan <= 0 {
+			err = errors.New("归档策略的 older_than 必须大于 0: " + p.Name)
+			return
+		}
+		if _, ok := d.schedules[p.Name]; ok {
+			err = errors.New("重复的归档策略: " + p.Name)
+			return
+		}
+		if d.schedules[p.Name], err = schedule.Parse(p.Schedule); err != nil {
+			return
+		}
+	}
+	if err = d.load(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *Daemon) load() (err error) {
+	d.history = History{LastScheduled: map[string]time.Time{}}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(d.file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(buf, &d.history); err != nil {
+		return
+	}
+	if d.history.LastScheduled == nil {
+		d.history.LastScheduled = map[string]time.Time{}
+	}
+	// 上次退出时未完成的任务，重新执行
+	for i, job := range d.history.Jobs {
+		if job.Status != JobRunning {
+			continue
+		}
+		log.Printf("任务被中断，将重新执行: %s", job.ID)
+		d.history.Jobs[i].Status = JobInterrupted
+		if last, ok := d.history.LastScheduled[job.Policy]; ok && !job.ScheduledAt.Before(last) {
+			d.history.LastScheduled[job.Policy] = job.ScheduledAt.Add(-time.Minute)
+		}
+	}
+	return
+}
+
+// save 在锁内调用
+func (d *Daemon) save() (err error) {
+	if len(d.history.Jobs) > maxJobs {
+		d.history.Jobs = d.history.Jobs[len(d.history.Jobs)-maxJobs:]
+	}
+	var buf []byte
+	if buf, err = json.MarshalIndent(d.history, "", "  "); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(d.file), 0755); err != nil {
+		return
+	}
+	tmp := d.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, d.file)
+}
+
+// Jobs 返回任务历史，最新的在前
+func (d *Daemon) Jobs() []Job {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := make([]Job, 0, len(d.history.Jobs))
+	for i := len(d.history.Jobs) - 1; i >= 0; i-- {
+		out = append(out, d.history.Jobs[i])
+	}
+	return out
+}
+
+// due 返回需要执行的策略，以及对应的计划时间，同时返回下一次检查的时间
+func (d *Daemon) due(now time.Time) (policies []Policy, scheduled []time.Time, catchUp []bool, wake time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, p := range d.policies {
+		s := d.schedules[p.Name]
+		last, ok := d.history.LastScheduled[p.Name]
+		if !ok {
+			// 第一次运行，不补执行
+			last = now
+			d.history.LastScheduled[p.Name] = last
+		}
+		next := s.Next(last)
+		if next.IsZero() {
+			continue
+		}
+		if !next.After(now) {
+			// 错过多次时只执行一次，使用最近的计划时间
+			missed := false
+			for n := s.Next(next); !n.IsZero() && !n.After(now); n = s.Next(n) {
+				next, missed = n, true
+			}
+			policies = append(policies, p)
+			scheduled = append(scheduled, next)
+			catchUp = append(catchUp, missed || now.Sub(next) > time.Minute)
+			next = s.Next(next)
+		}
+		if !next.IsZero() && (wake.IsZero() || next.Before(wake)) {
+			wake = next
+		}
+	}
+	return
+}
+
+func (d *Daemon) execute(ctx context.Context, p Policy, scheduled time.Time, catchUp bool) {
+	job := Job{
+		ID:          p.Name + "-" + strconv.FormatInt(scheduled.Unix(), 10),
+		Policy:      p.Name,
+		ScheduledAt: scheduled,
+		StartedAt:   time.Now(),
+		Status:      JobRunning,
+		CatchUp:     catchUp,
+	}
+	if catchUp {
+		log.Printf("补执行错过的任务: %s (%s)", p.Name, scheduled.Format(time.RFC3339))
+	} else {
+		log.Printf("开始执行任务: %s", job.ID)
+	}
+	d.lock.Lock()
+	d.history.LastScheduled[p.Name] = scheduled
+	d.history.Jobs = append(d.history.Jobs, job)
+	if err := d.save(); err != nil {
+		log.Printf("保存任务历史失败: %s", err.Error())
+	}
+	d.lock.Unlock()
+
+	err := d.run(ctx, p, &job)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+		if ctx.Err() != nil {
+			job.Status = JobInterrupted
+		}
+		log.Printf("任务失败: %s: %s", job.ID, err.Error())
+	} else {
+		job.Status = JobSucceeded
+		log.Printf("任务完成: %s", job.ID)
+	}
+	metrics.ObserveJob(metrics.KindPolicy, job.Status, now.Sub(job.StartedAt))
+	for i := range d.history.Jobs {
+		if d.history.Jobs[i].ID == job.ID {
+			d.history.Jobs[i] = job
+		}
+	}
+	if err := d.save(); err != nil {
+		log.Printf("保存任务历史失败: %s", err.Error())
+	}
+}
+
+// Run 按计划执行归档策略，直到 ctx 结束，同一时间只执行一个任务
+func (d *Daemon) Run(ctx context.Context) error {
+	for {
+		policies, scheduled, catchUp, wake := d.due(time.Now())
+		for i, p := range policies {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			d.execute(ctx, p, scheduled[i], catchUp[i])
+		}
+		if len(policies) > 0 {
+			// 执行期间可能已经到了下一次计划时间
+			continue
+		}
+		d.lock.Lock()
+		err := d.save()
+		d.lock.Unlock()
+		if err != nil {
+			log.Printf("保存任务历史失败: %s", err.Error())
+		}
+		if wake.IsZero() {
+			return errors.New("没有可以执行的归档策略")
+		}
+		log.Printf("下一次执行: %s", wake.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDaemonCatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbridge-daemon-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	buf, _ := json.Marshal(History{
+		Jobs: []Job{{ID: "b-1", Policy: "b", ScheduledAt: now.Add(-time.Hour), Status: JobRunning}},
+		LastScheduled: map[string]time.Time{
+			"a": time.Date(2020, 1, 7, 2, 0, 0, 0, time.UTC),
+			"b": now.Add(-time.Hour),
+		},
+	})
+	assert.NoError(t, ioutil.WriteFile(file, buf, 0644))
+
+	var ran []string
+	d, err := New([]Policy{
+		{Name: "a", Pattern: "a-*", OlderThan: 30, Schedule: "0 2 * * *"},
+		{Name: "b", Pattern: "b-*", OlderThan: 30, Schedule: "0 * * * *"},
+		{Name: "c", Pattern: "c-*", OlderThan: 30, Schedule: "0 3 * * *"},
+	}, file, func(ctx context.Context, p Policy, job *Job) error {
+		ran = append(ran, p.Name)
+		job.Indices = []string{p.Pattern}
+		if p.Name == "b" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, JobInterrupted, d.Jobs()[0].Status)
+
+	policies, scheduled, catchUp, wake := d.due(now)
+	assert.Len(t, policies, 2)
+	assert.Equal(t, "a", policies[0].Name)
+	assert.Equal(t, time.Date(2020, 1, 10, 2, 0, 0, 0, time.UTC), scheduled[0])
+	assert.True(t, catchUp[0])
+	// 中断的任务重新执行，错过的多次计划只执行最近的一次
+	assert.Equal(t, "b", policies[1].Name)
+	assert.Equal(t, now, scheduled[1])
+	// c 第一次运行，等待下一次计划时间
+	assert.Equal(t, now.Add(time.Hour), wake)
+
+	for i, p := range policies {
+		d.execute(context.Background(), p, scheduled[i], catchUp[i])
+	}
+	assert.Equal(t, []string{"a", "b"}, ran)
+	jobs := d.Jobs()
+	assert.Equal(t, JobFailed, jobs[0].Status)
+	assert.Equal(t, JobSucceeded, jobs[1].Status)
+	assert.Equal(t, []string{"a-*"}, jobs[1].Indices)
+
+	// 历史记录保存到文件中
+	d, err = New(d.policies, file, nil)
+	assert.NoError(t, err)
+	assert.Len(t, d.Jobs(), 3)
+	policies, _, _, _ = d.due(now)
+	assert.Len(t, policies, 0)
+}
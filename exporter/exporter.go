@@ -1,4 +1,4 @@
-package esexporter
+package exporter
 
 import (
 	"context"
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 var (
@@ -18,13 +19,21 @@ var (
 type SourceHandler func(buf []byte, id int64, total int64) error
 
 type Options struct {
-	Index         string
+	Index string
+	// Type 只搜索指定的 mapping type，留空时搜索索引中的所有文档，6.x 同样支持
 	Type          string
 	Query         elastic.Query
 	Scroll        string
 	BatchByteSize int64
 	BatchSize     int64
 	NoMappingType bool
+	// Hit handler 接收完整的 hits.hits 元素，而不仅是 _source，同时返回 _version
+	Hit bool
+	// SliceID 和 SliceMax 用于 sliced scroll，SliceMax <= 1 时不切分
+	SliceID  int
+	SliceMax int
+	// Observe 每次 search 或 scroll 请求完成后调用，参数为请求耗时
+	Observe func(d time.Duration)
 }
 
 type Exporter interface {
@@ -61,7 +70,7 @@ func (e *exporter) deleteScrollID() (err error) {
 }
 
 func (e *exporter) buildSearchPath() string {
-	if e.NoMappingType {
+	if e.NoMappingType || e.Type == "" {
 		return "/" + e.Index + "/_search"
 	} else {
 		return "/" + e.Index + "/" + e.Type + "/_search"
@@ -79,6 +88,19 @@ func (e *exporter) buildSearchBody(size interface{}) (b map[string]interface{},
 			return
 		}
 	}
+	if e.NoMappingType {
+		// 7.x 之后默认只统计到 10000
+		b["track_total_hits"] = true
+	}
+	if e.Hit {
+		b["version"] = true
+	}
+	if e.SliceMax > 1 {
+		b["slice"] = map[string]interface{}{
+			"id":  e.SliceID,
+			"max": e.SliceMax,
+		}
+	}
 	return
 }
 
@@ -117,6 +139,16 @@ func (e *exporter) estimateBatchSize(ctx context.Context) (err error) {
 	return
 }
 
+func (e *exporter) perform(ctx context.Context, opts elastic.PerformRequestOptions) (*elastic.Response, error) {
+	start := time.Now()
+	defer func() {
+		if e.Observe != nil {
+			e.Observe(time.Since(start))
+		}
+	}()
+	return e.client.PerformRequest(ctx, opts)
+}
+
 func (e *exporter) do(ctx context.Context) (err error) {
 	var res *elastic.Response
 	if e.scrollID == "" {
@@ -124,7 +156,7 @@ func (e *exporter) do(ctx context.Context) (err error) {
 		if body, err = e.buildSearchBody(e.size); err != nil {
 			return
 		}
-		if res, err = e.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		if res, err = e.perform(ctx, elastic.PerformRequestOptions{
 			Method: http.MethodPost,
 			Path:   e.buildSearchPath(),
 			Params: url.Values{"scroll": []string{e.Scroll}},
@@ -133,7 +165,7 @@ func (e *exporter) do(ctx context.Context) (err error) {
 			return
 		}
 	} else {
-		if res, err = e.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		if res, err = e.perform(ctx, elastic.PerformRequestOptions{
 			Method: http.MethodPost,
 			Path:   "/_search/scroll",
 			Body: map[string]interface{}{
@@ -169,7 +201,7 @@ func (e *exporter) do(ctx context.Context) (err error) {
 
 	// check total
 	var total int64
-	if total, err = jsonparser.GetInt(buf, "hits", "total"); err != nil {
+	if total, err = parseTotal(buf); err != nil {
 		return
 	}
 
@@ -205,6 +237,9 @@ func (e *exporter) do(ctx context.Context) (err error) {
 			itErr = errors.New("missing _source in hits.hits")
 			return
 		}
+		if e.Hit {
+			srcBuf = value
+		}
 		if itErr = e.handler(srcBuf, e.cursor, total); itErr != nil {
 			return
 		}
@@ -240,9 +275,6 @@ func (e *exporter) Do(ctx context.Context) (err error) {
 }
 
 func New(client *elastic.Client, opts Options, handler SourceHandler) Exporter {
-	if opts.Type == "" {
-		opts.Type = "_doc"
-	}
 	if opts.Scroll == "" {
 		opts.Scroll = "1m"
 	}
@@ -0,0 +1,435 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/olivere/elastic"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type PITOptions struct {
+	Index     string
+	Query     elastic.Query
+	KeepAlive string
+	BatchSize int64
+	// Sort 稳定的排序字段，search_after 依赖于此
+	//
+	// _shard_doc 只在同一个 point in time 中有效，需要跨 point in time 使用游标时，
+	// 应当使用时间字段加一个有 doc values 且唯一的字段作为稳定排序
+	Sort []string
+	// SearchAfter 从指定的排序值之后继续导出，用于断点续传，只能用于稳定排序
+	SearchAfter []interface{}
+	// OpenSearch 使用 OpenSearch 的 point in time 接口
+	OpenSearch bool
+	// Retries 单个请求出错后的重试次数，出错后从最后的排序值继续
+	//
+	// 稳定排序时重新打开 point in time，否则继续使用原有的 point in time
+	Retries int
+	// Hit handler 接收完整的 hits.hits 元素，而不仅是 _source，同时返回 _version
+	Hit      bool
+	SliceID  int
+	SliceMax int
+	// SliceField 切片使用的字段，需要有 doc values，留空时按文档编号切分，
+	// 重新打开 point in time 后切片可能变化
+	SliceField string
+	// Observe 每次 search 请求完成后调用，参数为请求耗时
+	Observe func(d time.Duration)
+}
+
+// CursorExporter 可以获取当前游标的导出器，游标为当前或最后一个已处理文档的排序值
+type CursorExporter interface {
+	Exporter
+	Cursor() []interface{}
+}
+
+type pitExporter struct {
+	PITOptions
+
+	client  *elastic.Client
+	handler SourceHandler
+
+	pitID  string
+	cursor int64
+}
+
+// stable 排序值和切片是否可以跨 point in time 使用
+func (e *pitExporter) stable() bool {
+	if e.SliceMax > 1 && e.SliceField == "" {
+		return false
+	}
+	for _, field := range e.Sort {
+		if field == "_shard_doc" || field == "_id" {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *pitExporter) Cursor() []interface{} {
+	return e.SearchAfter
+}
+
+func (e *pitExporter) openPIT(ctx context.Context) (err error) {
+	path := "/" + e.Index + "/_pit"
+	if e.OpenSearch {
+		path = "/" + e.Index + "/_search/point_in_time"
+	}
+	var res *elastic.Response
+	if res, err = e.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   path,
+		Params: url.Values{"keep_alive": []string{e.KeepAlive}},
+	}); err != nil {
+		return
+	}
+	key := "id"
+	if e.OpenSearch {
+		key = "pit_id"
+	}
+	if e.pitID, err = jsonparser.GetString(res.Body, key); err != nil {
+		return
+	}
+	return
+}
+
+func (e *pitExporter) closePIT() (err error) {
+	pitID := e.pitID
+	if pitID == "" {
+		return
+	}
+	opts := elastic.PerformRequestOptions{
+		Method: http.MethodDelete,
+		Path:   "/_pit",
+		Body:   map[string]interface{}{"id": pitID},
+	}
+	if e.OpenSearch {
+		opts.Path = "/_search/point_in_time"
+		opts.Body = map[string]interface{}{"pit_id": []string{pitID}}
+	}
+	_, err = e.client.PerformRequest(context.Background(), opts)
+	return
+}
+
+func (e *pitExporter) buildSearchBody() (b map[string]interface{}, err error) {
+	sort := make([]interface{}, 0, len(e.Sort))
+	for _, field := range e.Sort {
+		if strings.HasPrefix(field, "_") {
+			sort = append(sort, map[string]interface{}{field: "asc"})
+			continue
+		}
+		// 普通字段一般为时间字段，索引中没有该字段时按缺失处理
+		sort = append(sort, map[string]interface{}{field: map[string]interface{}{
+			"order":         "asc",
+			"unmapped_type": "date",
+		}})
+	}
+	b = map[string]interface{}{
+		"size":             e.BatchSize,
+		"sort":             sort,
+		"track_total_hits": true,
+		"pit": map[string]interface{}{
+			"id":         e.pitID,
+			"keep_alive": e.KeepAlive,
+		},
+	}
+	if e.Query != nil {
+		if b["query"], err = e.Query.Source(); err != nil {
+			return
+		}
+	}
+	if len(e.SearchAfter) > 0 {
+		b["search_after"] = e.SearchAfter
+	}
+	if e.Hit {
+		b["version"] = true
+	}
+	if e.SliceMax > 1 {
+		slice := map[string]interface{}{
+			"id":  e.SliceID,
+			"max": e.SliceMax,
+		}
+		if e.SliceField != "" {
+			slice["field"] = e.SliceField
+		}
+		b["slice"] = slice
+	}
+	return
+}
+
+func (e *pitExporter) do(ctx context.Context) (err error) {
+	var body interface{}
+	if body, err = e.buildSearchBody(); err != nil {
+		return
+	}
+	var res *elastic.Response
+	start := time.Now()
+	res, err = e.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/_search",
+		Body:   body,
+	})
+	if e.Observe != nil {
+		e.Observe(time.Since(start))
+	}
+	if err != nil {
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http request failed: %d: %s", res.StatusCode, res.Body)
+		return
+	}
+
+	buf := res.Body
+
+	// point in time id may change between requests
+	if pitID, _ := jsonparser.GetString(buf, "pit_id"); pitID != "" {
+		e.pitID = pitID
+	}
+
+	// check shards failed
+	var shardsFailed int64
+	if shardsFailed, err = jsonparser.GetInt(buf, "_shards", "failed"); err != nil {
+		return
+	}
+	if shardsFailed != 0 {
+		err = errors.New("_shards.failed != 0")
+		return
+	}
+
+	var total int64
+	if total, err = parseTotal(buf); err != nil {
+		return
+	}
+
+	var hitsBuf []byte
+	var hitsType jsonparser.ValueType
+	if hitsBuf, hitsType, _, err = jsonparser.Get(buf, "hits", "hits"); err != nil {
+		return
+	}
+	if hitsType != jsonparser.Array {
+		err = errors.New("hits.hits is not array")
+		return
+	}
+
+	var itErr error
+	var itCalled bool
+	_, _ = jsonparser.ArrayEach(hitsBuf, func(value []byte, dataType jsonparser.ValueType, offset int, docErr error) {
+		itCalled = true
+		if itErr != nil {
+			return
+		}
+		if docErr != nil {
+			itErr = docErr
+			return
+		}
+		srcBuf, srcType, _, srcErr := jsonparser.Get(value, "_source")
+		if srcErr != nil {
+			itErr = srcErr
+			return
+		}
+		if srcType != jsonparser.Object {
+			itErr = errors.New("missing _source in hits.hits")
+			return
+		}
+		sortBuf, _, _, sortErr := jsonparser.Get(value, "sort")
+		if sortErr != nil {
+			itErr = sortErr
+			return
+		}
+		var sort []interface{}
+		if itErr = decodeUseNumber(sortBuf, &sort); itErr != nil {
+			return
+		}
+		// handler 中可以通过 Cursor() 获取当前文档的排序值
+		e.SearchAfter = sort
+		if e.Hit {
+			srcBuf = value
+		}
+		if itErr = e.handler(srcBuf, e.cursor, total); itErr != nil {
+			return
+		}
+		e.cursor = e.cursor + 1
+	})
+
+	if itErr != nil {
+		err = itErr
+		return
+	}
+
+	if !itCalled {
+		err = io.EOF
+		return
+	}
+
+	return
+}
+
+func (e *pitExporter) Do(ctx context.Context) (err error) {
+	if err = e.openPIT(ctx); err != nil {
+		return
+	}
+	defer func() {
+		_ = e.closePIT()
+	}()
+	retries := 0
+	for {
+		if err = e.do(ctx); err != nil {
+			if err == ErrUserCancelled || err == io.EOF {
+				err = nil
+				return
+			}
+			if he, ok := err.(handlerError); ok {
+				err = he.error
+				return
+			}
+			if ctx.Err() != nil || retries >= e.Retries {
+				return
+			}
+			retries++
+			wait := time.Second << uint(retries-1)
+			joblog.Printf(ctx, "导出请求失败，%s 后从游标 %v 继续: %s", wait, e.SearchAfter, err.Error())
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(wait):
+			}
+			if !e.stable() {
+				continue
+			}
+			// point in time 可能已经过期，稳定排序的游标在新的 point in time 中依然有效
+			_ = e.closePIT()
+			if err = e.openPIT(ctx); err != nil {
+				return
+			}
+			continue
+		}
+		retries = 0
+	}
+}
+
+// handlerError 包装 handler 返回的错误，这类错误不进行重试
+type handlerError struct {
+	error
+}
+
+func NewPIT(client *elastic.Client, opts PITOptions, handler SourceHandler) CursorExporter {
+	if opts.KeepAlive == "" {
+		opts.KeepAlive = "10m"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if len(opts.Sort) == 0 {
+		if opts.OpenSearch {
+			opts.Sort = []string{"_id"}
+		} else {
+			opts.Sort = []string{"_shard_doc"}
+		}
+	}
+	if handler == nil {
+		handler = func(buf []byte, idx int64, total int64) error { return nil }
+	}
+	return &pitExporter{
+		PITOptions: opts,
+		client:     client,
+		handler: func(buf []byte, id int64, total int64) error {
+			if err := handler(buf, id, total); err != nil {
+				if err == ErrUserCancelled {
+					return err
+				}
+				return handlerError{err}
+			}
+			return nil
+		},
+	}
+}
+
+// parseTotal 解析 hits.total，兼容 6.x 的数字和 7.x 之后的对象形式
+func parseTotal(buf []byte) (total int64, err error) {
+	var val []byte
+	var typ jsonparser.ValueType
+	if val, typ, _, err = jsonparser.Get(buf, "hits", "total"); err != nil {
+		return
+	}
+	switch typ {
+	case jsonparser.Number:
+		return jsonparser.ParseInt(val)
+	case jsonparser.Object:
+		return jsonparser.GetInt(val, "value")
+	default:
+		err = errors.New("hits.total is neither number nor object")
+		return
+	}
+}
+
+func decodeUseNumber(buf []byte, out interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+// CompareCursor 按顺序比较两组排序值，nil 小于任何非空游标
+func CompareCursor(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareSortValue(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareSortValue(a, b interface{}) int {
+	na, aok := a.(json.Number)
+	nb, bok := b.(json.Number)
+	if aok && bok {
+		if ia, err := na.Int64(); err == nil {
+			if ib, err := nb.Int64(); err == nil {
+				switch {
+				case ia < ib:
+					return -1
+				case ia > ib:
+					return 1
+				default:
+					return 0
+				}
+			}
+		}
+		fa, _ := na.Float64()
+		fb, _ := nb.Float64()
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		default:
+			return 0
+		}
+	}
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case sa < sb:
+		return -1
+	case sa > sb:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -4,13 +4,17 @@ go 1.14
 
 require (
 	github.com/buger/jsonparser v1.0.0
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fortytw2/leaktest v1.3.0 // indirect
+	github.com/google/go-cmp v0.4.1 // indirect
 	github.com/guoyk93/conc v1.1.1
-	github.com/guoyk93/esexporter v1.4.0
 	github.com/guoyk93/iocount v1.0.0
 	github.com/guoyk93/logutil v1.0.1
 	github.com/klauspost/compress v1.10.8 // indirect
 	github.com/klauspost/pgzip v1.2.4
+	github.com/mailru/easyjson v0.7.1 // indirect
 	github.com/olivere/elastic v6.2.33+incompatible
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.6.1
 	github.com/tencentyun/cos-go-sdk-v5 v0.7.6
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
@@ -0,0 +1,50 @@
+package joblog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+type contextKey struct{}
+
+// With 返回属于某个任务的 context，通过 Printf 输出的日志同时写入 w
+func With(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, contextKey{}, log.New(w, "", log.LstdFlags))
+}
+
+// Detach 返回不会被取消的 context，保留 ctx 所属任务的日志，用于任务取消后的清理
+func Detach(ctx context.Context) context.Context {
+	if l, ok := ctx.Value(contextKey{}).(*log.Logger); ok {
+		return context.WithValue(context.Background(), contextKey{}, l)
+	}
+	return context.Background()
+}
+
+// Printf 输出到标准日志，ctx 属于某个任务时同时写入该任务的日志
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	output(ctx, fmt.Sprintf(format, v...))
+}
+
+// Println 与 Printf 相同，参数的格式与 log.Println 一致
+func Println(ctx context.Context, v ...interface{}) {
+	output(ctx, fmt.Sprintln(v...))
+}
+
+// Printer 返回绑定了 ctx 的 Printf，用于 logutil.LoggerFunc
+func Printer(ctx context.Context) func(format string, v ...interface{}) {
+	return func(format string, v ...interface{}) {
+		Printf(ctx, format, v...)
+	}
+}
+
+func output(ctx context.Context, s string) {
+	_ = log.Output(3, s)
+	if ctx == nil {
+		return
+	}
+	if l, ok := ctx.Value(contextKey{}).(*log.Logger); ok {
+		_ = l.Output(3, s)
+	}
+}
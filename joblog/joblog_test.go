@@ -0,0 +1,29 @@
+package joblog
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestPrintf(t *testing.T) {
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	ctxA := With(context.Background(), a)
+	ctxB := With(context.Background(), b)
+	Printf(ctxA, "任务 %s", "a")
+	Println(ctxB, "任务", "b")
+	Printf(context.Background(), "其他日志")
+	assert.True(t, strings.HasSuffix(a.String(), "任务 a\n"))
+	assert.True(t, strings.HasSuffix(b.String(), "任务 b\n"))
+	assert.Equal(t, 1, strings.Count(a.String(), "\n"))
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+
+	ctx, cancel := context.WithCancel(ctxA)
+	cancel()
+	detached := Detach(ctx)
+	assert.NoError(t, detached.Err())
+	Printf(detached, "清理")
+	assert.True(t, strings.HasSuffix(a.String(), "清理\n"))
+}
@@ -0,0 +1,216 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("任务不存在")
+	ErrFinished = errors.New("任务已经结束")
+)
+
+// Job 通过 API 提交的任务
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Params     interface{} `json:"params"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Error      string      `json:"error,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	task   conc.Task
+	done   chan struct{}
+	logs   *LogBuffer
+}
+
+func (j *Job) finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+// Manager 管理任务，按提交顺序执行，同时运行的任务数不超过 limit
+type Manager struct {
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	pending []*Job
+	running int
+	limit   int
+	seq     int64
+	// logLines 每个任务保留的日志行数
+	logLines int
+}
+
+func NewManager(limit int, logLines int) *Manager {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Manager{
+		jobs:     map[string]*Job{},
+		limit:    limit,
+		logLines: logLines,
+	}
+}
+
+// Submit 提交任务，任务在后台排队执行
+func (m *Manager) Submit(kind string, params interface{}, task conc.Task) Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		ID:        time.Now().Format("20060102150405") + "-" + strconv.FormatInt(atomic.AddInt64(&m.seq, 1), 10),
+		Kind:      kind,
+		Params:    params,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		task:      task,
+		done:      make(chan struct{}),
+		logs:      NewLogBuffer(m.logLines),
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.jobs[j.ID] = j
+	m.pending = append(m.pending, j)
+	m.dispatch()
+	return *j
+}
+
+// dispatch 在锁内调用，启动排队中的任务
+func (m *Manager) dispatch() {
+	for m.running < m.limit && len(m.pending) > 0 {
+		j := m.pending[0]
+		m.pending = m.pending[1:]
+		m.running++
+		j.Status = StatusRunning
+		now := time.Now()
+		j.StartedAt = &now
+		go m.run(j)
+	}
+}
+
+func (m *Manager) run(j *Job) {
+	// 任务中通过 joblog 输出的日志只写入该任务自己的日志
+	ctx := joblog.With(j.ctx, j.logs)
+	joblog.Printf(ctx, "开始执行任务: %s (%s)", j.ID, j.Kind)
+	err := j.task.Do(ctx)
+	if err != nil {
+		joblog.Printf(ctx, "任务失败: %s: %s", j.ID, err.Error())
+	} else {
+		joblog.Printf(ctx, "任务完成: %s", j.ID)
+	}
+	if err != nil && j.ctx.Err() != nil {
+		err = j.ctx.Err()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.running--
+	m.finish(j, err)
+	metrics.ObserveJob(j.Kind, j.Status, j.FinishedAt.Sub(*j.StartedAt))
+	m.dispatch()
+}
+
+// finish 在锁内调用
+func (m *Manager) finish(j *Job, err error) {
+	now := time.Now()
+	j.FinishedAt = &now
+	switch {
+	case err == context.Canceled:
+		j.Status = StatusCancelled
+	case err != nil:
+		j.Status, j.Error = StatusFailed, err.Error()
+	default:
+		j.Status = StatusSucceeded
+	}
+	j.cancel()
+	close(j.done)
+}
+
+// List 返回所有任务，最新的在前
+func (m *Manager) List() []Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	out := make([]Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		out = append(out, *j)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+	return out
+}
+
+func (m *Manager) Get(id string) (j Job, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	j = *job
+	return
+}
+
+// Cancel 取消排队中或者运行中的任务
+func (m *Manager) Cancel(id string) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if j.finished() {
+		return ErrFinished
+	}
+	j.cancel()
+	// 排队中的任务直接结束
+	for i, p := range m.pending {
+		if p == j {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			m.finish(j, context.Canceled)
+			break
+		}
+	}
+	return
+}
+
+// Logs 返回任务的日志
+func (m *Manager) Logs(id string) (*LogBuffer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return j.logs, nil
+}
+
+// Done 返回任务结束时关闭的 channel
+func (m *Manager) Done(id string) (<-chan struct{}, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return j.done, nil
+}
@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"github.com/guoyk93/conc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(3)
+	_, _ = b.Write([]byte("a\nb"))
+	assert.Equal(t, int64(1), b.Seq())
+	_, _ = b.Write([]byte("\nc\nd\n"))
+	assert.Equal(t, int64(4), b.Seq())
+	lines, next := b.Read(0, -1)
+	assert.Equal(t, []string{"b", "c", "d"}, lines)
+	assert.Equal(t, int64(4), next)
+	lines, next = b.Read(2, 3)
+	assert.Equal(t, []string{"c"}, lines)
+	assert.Equal(t, int64(3), next)
+	lines, next = b.Read(4, -1)
+	assert.Empty(t, lines)
+	assert.Equal(t, int64(4), next)
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager(1, 100)
+	block := make(chan struct{})
+	j1 := m.Submit("a", nil, conc.TaskFunc(func(ctx context.Context) error {
+		select {
+		case <-block:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}))
+	j2 := m.Submit("b", nil, conc.TaskFunc(func(ctx context.Context) error {
+		return errors.New("failed")
+	}))
+	j3 := m.Submit("c", nil, conc.TaskFunc(func(ctx context.Context) error {
+		return nil
+	}))
+
+	time.Sleep(50 * time.Millisecond)
+	j, err := m.Get(j2.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, j.Status)
+
+	assert.NoError(t, m.Cancel(j3.ID))
+	assert.NoError(t, m.Cancel(j1.ID))
+	for _, id := range []string{j1.ID, j2.ID, j3.ID} {
+		done, err := m.Done(id)
+		assert.NoError(t, err)
+		<-done
+	}
+	j, _ = m.Get(j1.ID)
+	assert.Equal(t, StatusCancelled, j.Status)
+	j, _ = m.Get(j2.ID)
+	assert.Equal(t, StatusFailed, j.Status)
+	assert.Equal(t, "failed", j.Error)
+	j, _ = m.Get(j3.ID)
+	assert.Equal(t, StatusCancelled, j.Status)
+	assert.Equal(t, ErrFinished, m.Cancel(j1.ID))
+	assert.Len(t, m.List(), 3)
+	close(block)
+}
@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"bytes"
+	"sync"
+)
+
+// LogBuffer 保存任务最近的日志行，用于查看任务进度
+type LogBuffer struct {
+	lock    sync.Mutex
+	lines   []string
+	first   int64
+	partial []byte
+	max     int
+}
+
+func NewLogBuffer(max int) *LogBuffer {
+	return &LogBuffer{max: max}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines = append(b.lines, string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = append([]string{}, b.lines[over:]...)
+		b.first += int64(over)
+	}
+	return len(p), nil
+}
+
+// Seq 下一行日志的序号
+func (b *LogBuffer) Seq() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.first + int64(len(b.lines))
+}
+
+// Read 返回序号从 from 开始到 to 之前的日志，to 小于 0 时不限制，同时返回下一次读取的序号
+func (b *LogBuffer) Read(from, to int64) (lines []string, next int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if from < b.first {
+		from = b.first
+	}
+	end := b.first + int64(len(b.lines))
+	if to >= 0 && to < end {
+		end = to
+	}
+	if from >= end {
+		return nil, from
+	}
+	lines = append(lines, b.lines[from-b.first:end-b.first]...)
+	next = end
+	return
+}
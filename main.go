@@ -4,20 +4,29 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/bulk"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
 	"github.com/guoyk93/esbridge/tasks"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/olivere/elastic"
-	"github.com/tencentyun/cos-go-sdk-v5"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	_ "net/http/pprof"
 )
 
 var (
+	// Version 构建时通过 -ldflags "-X main.Version=..." 设置
+	Version = "dev"
+
 	conf Conf
 
 	optConf        string
@@ -28,6 +37,42 @@ var (
 	optBatchSize   int
 	optConcurrency int
 	optNeo         bool
+	optStream      bool
+	optPartSize    int64
+	optSlices      int
+	optEngine      string
+	optResume      bool
+	optTimestamp   string
+	optTiebreaker  string
+	optRestoreMode string
+	optShards      int
+	optReplicas    int
+	optAllocation  string
+	optTemplate    string
+	optTarget      string
+	optAlias       string
+
+	optMigratePattern   string
+	optOlderThan        int
+	optDateLayout       string
+	optIndexConcurrency int
+	optServe            bool
+	optVerify           string
+
+	optBulkWorkers       int
+	optBulkActions       int
+	optBulkSize          int64
+	optBulkFlushInterval time.Duration
+	optBulkRetries       int
+	optBulkBackoff       time.Duration
+	optBulkMaxBackoff    time.Duration
+	optDeadLetter        string
+	optMaxDocsPerSecond  float64
+	optMaxMBPerSecond    float64
+	optFilter            string
+	optFilterFrom        string
+	optFilterTo          string
+	optVerifyFirst       bool
 
 	optBestCompression bool
 	optBestSpeed       bool
@@ -35,21 +80,68 @@ var (
 
 func load() (err error) {
 	flag.BoolVar(&optNeo, "neo", false, "neo")
+	flag.BoolVar(&optStream, "stream", false, "导出时直接分块上传到存储，不使用本地工作空间")
+	flag.Int64Var(&optPartSize, "part-size", 16, "流式上传时的分块大小，单位 MB")
 	flag.StringVar(&optConf, "conf", "/etc/esbridge.yml", "配置文件")
 	flag.StringVar(&optMigrate, "migrate", "", "要迁移的离线索引, ")
-	flag.StringVar(&optRestore, "restore", "", "要恢复的离线索引, 格式为 INDEX/PROJECT")
+	flag.StringVar(&optMigratePattern, "migrate-pattern", "", "批量迁移匹配的索引，例如 logs-*")
+	flag.IntVar(&optOlderThan, "older-than", 30, "批量迁移时只迁移早于指定天数的索引")
+	flag.StringVar(&optDateLayout, "date-layout", "", "索引名中日期的格式，例如 2006.01.02，默认自动识别，无法识别时使用索引的创建时间")
+	flag.IntVar(&optIndexConcurrency, "index-concurrency", 1, "批量迁移时同时迁移的索引数")
+	flag.BoolVar(&optServe, "serve", false, "常驻运行，按配置文件中的归档策略定时迁移索引")
+	flag.StringVar(&optVerify, "verify", "", "校验归档与描述文件是否一致, 格式与 -restore 相同")
+	flag.StringVar(&optRestore, "restore", "", "要恢复的离线索引, 格式为 INDEX/PROJECT, 支持通配符和逗号分隔的列表, 多个以分号分隔")
+	flag.StringVar(&optRestoreMode, "restore-mode", RestoreModeOverwrite, "恢复模式，可选 overwrite, create, fail, external-version")
+	flag.StringVar(&optTemplate, "template", "", "恢复时使用的模板，默认按配置文件中的规则选择")
+	flag.StringVar(&optTarget, "target", "", "恢复的目标索引，支持 {index} 和 {project}，例如 restored-{index}-{project}，覆盖模板中的设置")
+	flag.StringVar(&optAlias, "alias", "", "目标索引与原索引不同时创建的别名，支持 {index} 和 {project}，默认为 "+DefaultRestoreAlias+"，设置为空时不创建")
+	flag.IntVar(&optShards, "shards", -1, "恢复时新建索引的分片数，覆盖模板中的设置，-1 表示使用归档中的设置")
+	flag.IntVar(&optReplicas, "replicas", -1, "恢复时新建索引的副本数，覆盖模板中的设置，-1 表示使用归档中的设置")
+	flag.StringVar(&optAllocation, "allocation", "", "恢复时索引的分配设置，覆盖模板中的设置，格式为 require.disktype=hdd，多个以逗号分隔")
+	flag.IntVar(&optBulkWorkers, "bulk-workers", bulk.DefaultWorkers, "恢复单个项目时同时进行的 bulk 请求数，覆盖配置文件中的设置")
+	flag.IntVar(&optBulkActions, "bulk-actions", bulk.DefaultActions, "恢复时单个 bulk 请求的最大文档数，覆盖配置文件中的设置")
+	flag.Int64Var(&optBulkSize, "bulk-size", bulk.DefaultBytes/1024/1024, "恢复时单个 bulk 请求的最大大小，单位 MB，覆盖配置文件中的设置")
+	flag.DurationVar(&optBulkFlushInterval, "bulk-flush-interval", bulk.DefaultFlushInterval, "恢复时未满的 bulk 请求最长等待时间，覆盖配置文件中的设置")
+	flag.IntVar(&optBulkRetries, "bulk-retries", bulk.DefaultRetries, "恢复时被拒绝或者暂时失败的文档最多重试的次数，覆盖配置文件中的设置")
+	flag.DurationVar(&optBulkBackoff, "bulk-backoff", bulk.DefaultBackoff, "恢复时第一次重试前的等待时间，之后指数增长，覆盖配置文件中的设置")
+	flag.DurationVar(&optBulkMaxBackoff, "bulk-max-backoff", bulk.DefaultMaxBackoff, "恢复时重试前的最长等待时间，覆盖配置文件中的设置")
+	flag.StringVar(&optDeadLetter, "dead-letter", "", "恢复时无法写入的文档的处理方式，可选 local (写入工作目录), storage (上传到存储中的 INDEX/PROJECT"+tasks.ExtDeadLetter+")，为空时恢复失败，覆盖配置文件中的设置")
+	flag.Float64Var(&optMaxDocsPerSecond, "max-docs-per-second", 0, "恢复时每秒写入的最大文档数，所有项目共享，0 表示不限制，覆盖配置文件中的设置")
+	flag.Float64Var(&optMaxMBPerSecond, "max-mb-per-second", 0, "恢复时每秒写入的最大未压缩数据量，单位 MB，所有项目共享，0 表示不限制，覆盖配置文件中的设置")
+	flag.StringVar(&optFilter, "filter", "", `恢复时只写入满足条件的文档，语法为 Elasticsearch 查询的子集，例如 {"term":{"host.name":"web-1"}}，以 @ 开头时从文件读取`)
+	flag.StringVar(&optFilterFrom, "filter-from", "", "恢复时只写入 -timestamp-field 不早于指定时间的文档，例如 2020-01-02T03:00:00+08:00")
+	flag.StringVar(&optFilterTo, "filter-to", "", "恢复时只写入 -timestamp-field 早于指定时间的文档")
+	flag.BoolVar(&optVerifyFirst, "verify-first", false, "恢复前先完整下载并校验归档，需要额外下载一次，默认在恢复过程中校验")
 	flag.StringVar(&optSearch, "search", "", "要搜索的关键字")
 	flag.IntVar(&optBatchSize, "batch-size", 2000, "导出时的每批次大小")
-	flag.IntVar(&optConcurrency, "concurrency", 3, "导出时的并发数")
+	flag.IntVar(&optConcurrency, "concurrency", 3, "导出和恢复时的并发数")
+	flag.IntVar(&optSlices, "slices", 1, "单个导出使用的切片数")
+	flag.StringVar(&optEngine, "engine", "auto", "导出方式，可选 auto, scroll, pit")
 	flag.BoolVar(&optNoDelete, "no-delete", false, "迁移时不删除索引，仅用于测试")
+	flag.BoolVar(&optResume, "resume", false, "从上次中断的进度继续迁移")
+	flag.StringVar(&optTimestamp, "timestamp-field", tasks.DefaultTimestampField, "描述文件中统计时间范围使用的字段")
+	flag.StringVar(&optTiebreaker, "pit-tiebreaker", "", "pit 导出时与时间字段一起排序的字段，需要有 doc values 且每个文档唯一，指定后中断的流式上传可以继续")
 	flag.BoolVar(&optBestCompression, "best-compression", false, "最佳压缩率")
 	flag.BoolVar(&optBestSpeed, "best-speed", false, "最佳压缩速度")
 	flag.Parse()
 
 	optConf = strings.TrimSpace(optConf)
 	optMigrate = strings.TrimSpace(optMigrate)
+	optMigratePattern = strings.TrimSpace(optMigratePattern)
+	optDateLayout = strings.TrimSpace(optDateLayout)
 	optRestore = strings.TrimSpace(optRestore)
+	optVerify = strings.TrimSpace(optVerify)
 	optSearch = strings.TrimSpace(optSearch)
+	optEngine = strings.TrimSpace(optEngine)
+	optTimestamp = strings.TrimSpace(optTimestamp)
+	optTiebreaker = strings.TrimSpace(optTiebreaker)
+	optRestoreMode = strings.TrimSpace(optRestoreMode)
+	optDeadLetter = strings.TrimSpace(optDeadLetter)
+
+	if optPartSize*1024*1024 < storage.MinPartSize {
+		err = fmt.Errorf("-part-size 不能小于 %dMB", storage.MinPartSize/1024/1024)
+		return
+	}
 
 	if conf, err = LoadConf(optConf); err != nil {
 		return
@@ -64,6 +156,152 @@ func checkIndex(index string) error {
 	return nil
 }
 
+// resolveRestoreTemplate 获取恢复模板，并使用命令行中明确指定的参数覆盖
+func resolveRestoreTemplate(index string) (tpl RestoreTemplate, err error) {
+	if tpl, err = ResolveRestoreTemplate(conf, optTemplate, index); err != nil {
+		return
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "shards":
+			shards := optShards
+			tpl.Shards = &shards
+		case "replicas":
+			replicas := optReplicas
+			tpl.Replicas = &replicas
+		case "target":
+			tpl.Target = strings.TrimSpace(optTarget)
+		case "alias":
+			tpl.Alias = strings.TrimSpace(optAlias)
+		}
+	})
+	if optAllocation != "" {
+		if tpl.Allocation, err = parseAllocation(optAllocation); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// restoreBulkOptions 获取恢复时写入数据的批次设置，并使用命令行中明确指定的参数覆盖
+func restoreBulkOptions() (opts bulk.Options, err error) {
+	if opts, err = conf.Restore.Bulk.Options(); err != nil {
+		return
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bulk-workers":
+			opts.Workers = optBulkWorkers
+		case "bulk-actions":
+			opts.Actions = optBulkActions
+		case "bulk-size":
+			opts.Bytes = optBulkSize * 1024 * 1024
+		case "bulk-flush-interval":
+			opts.FlushInterval = optBulkFlushInterval
+		case "bulk-retries":
+			opts.Retries = optBulkRetries
+		case "bulk-backoff":
+			opts.Backoff = optBulkBackoff
+		case "bulk-max-backoff":
+			opts.MaxBackoff = optBulkMaxBackoff
+		}
+	})
+	return
+}
+
+// restoreRateLimit 获取恢复时的速率限制，命令行中明确指定的参数优先
+func restoreRateLimit(conf Conf) (l RestoreRateLimit, err error) {
+	l = conf.Restore.RateLimit
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-docs-per-second":
+			l.DocumentsPerSecond = optMaxDocsPerSecond
+		case "max-mb-per-second":
+			l.MBPerSecond = optMaxMBPerSecond
+		}
+	})
+	err = l.Check()
+	return
+}
+
+// restoreDeadLetter 获取死信的处理方式，命令行中明确指定的参数优先
+func restoreDeadLetter() string {
+	mode := conf.Restore.DeadLetter
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "dead-letter" {
+			mode = optDeadLetter
+		}
+	})
+	return mode
+}
+
+// deadLetterDir 死信文件所在的本地目录
+func deadLetterDir() string {
+	return filepath.Join(conf.Workspace, "deadletter")
+}
+
+func migrateOptions(index string, store storage.Storage, clientES *elastic.Client, info cluster.Info, engine string) tasks.IndexMigrateOptions {
+	return tasks.IndexMigrateOptions{
+		ESClient:         clientES,
+		Storage:          store,
+		NoDelete:         optNoDelete,
+		Dir:              conf.Workspace,
+		Index:            index,
+		BatchSize:        optBatchSize,
+		Concurrency:      optConcurrency,
+		CompressionLevel: gzip.BestCompression,
+		Stream:           optStream,
+		PartSize:         optPartSize * 1024 * 1024,
+		PartRetries:      storage.DefaultPartRetries,
+		Slices:           optSlices,
+		Engine:           engine,
+		Cluster:          info,
+		Resume:           optResume,
+		TimestampField:   optTimestamp,
+		Tiebreaker:       optTiebreaker,
+		Version:          Version,
+	}
+}
+
+func migrateIndex(opts tasks.IndexMigrateOptions) conc.Task {
+	task := tasks.IndexMigrate(opts)
+	if optNeo {
+		task = tasks.IndexMigrateNeo(opts)
+	}
+	return conc.TaskFunc(func(ctx context.Context) (err error) {
+		var unlock func()
+		if unlock, err = lockMigration(opts.Index); err != nil {
+			return
+		}
+		defer unlock()
+		start := time.Now()
+		err = task.Do(ctx)
+		outcome := metrics.Outcome(err)
+		metrics.Migrations.With(opts.Index, outcome).Inc()
+		metrics.ObserveJob(metrics.KindIndexMigrate, outcome, time.Since(start))
+		return
+	})
+}
+
+func resolveEngine(info cluster.Info) (string, error) {
+	switch optEngine {
+	case "auto":
+		if info.SupportsPIT() {
+			return tasks.EnginePIT, nil
+		}
+		return tasks.EngineScroll, nil
+	case tasks.EngineScroll:
+		return tasks.EngineScroll, nil
+	case tasks.EnginePIT:
+		if !info.SupportsPIT() {
+			return "", errors.New("集群不支持 point in time 搜索: " + info.String())
+		}
+		return tasks.EnginePIT, nil
+	default:
+		return "", errors.New("未知的导出方式: " + optEngine)
+	}
+}
+
 func exit(err *error) {
 	if *err != nil {
 		log.Printf("exited with error: %s", (*err).Error())
@@ -81,7 +319,17 @@ func main() {
 		return
 	}
 
-	// pprof
+	var rl RestoreRateLimit
+	if rl, err = restoreRateLimit(conf); err != nil {
+		return
+	}
+	if rl != (RestoreRateLimit{}) {
+		restoreThrottle.Set(rl)
+	}
+	go watchRateLimitReload()
+
+	// pprof 和监控指标
+	http.Handle("/metrics", metrics.Default.Handler())
 	go func() {
 		log.Print(http.ListenAndServe(conf.PProf.Bind, nil))
 	}()
@@ -96,11 +344,26 @@ func main() {
 		return
 	}
 
-	// setup cos
-	var clientCOS *cos.Client
-	u, _ := url.Parse(conf.COS.URL)
-	b := &cos.BaseURL{BucketURL: u}
-	clientCOS = cos.NewClient(b, &http.Client{Transport: &cos.AuthorizationTransport{SecretID: conf.COS.SecretID, SecretKey: conf.COS.SecretKey}})
+	// detect cluster
+	var info cluster.Info
+	if info, err = cluster.Detect(context.Background(), clientES); err != nil {
+		return
+	}
+	log.Printf("集群信息: %s", info.String())
+	if err = info.Check(); err != nil {
+		return
+	}
+
+	var engine string
+	if engine, err = resolveEngine(info); err != nil {
+		return
+	}
+
+	// setup storage
+	var store storage.Storage
+	if store, err = CreateStorage(conf); err != nil {
+		return
+	}
 
 	switch {
 	case optMigrate != "":
@@ -110,69 +373,90 @@ func main() {
 			return
 		}
 
-		if optNeo {
-			if err = tasks.IndexMigrateNeo(tasks.IndexMigrateOptions{
-				ESClient:         clientES,
-				COSClient:        clientCOS,
-				NoDelete:         optNoDelete,
-				Dir:              conf.Workspace,
-				Index:            index,
-				BatchSize:        optBatchSize,
-				Concurrency:      optConcurrency,
-				CompressionLevel: gzip.BestCompression,
-			}).Do(context.Background()); err != nil {
-				return
-			}
-		} else {
-			if err = tasks.IndexMigrate(tasks.IndexMigrateOptions{
-				ESClient:         clientES,
-				COSClient:        clientCOS,
-				NoDelete:         optNoDelete,
-				Dir:              conf.Workspace,
-				Index:            index,
-				BatchSize:        optBatchSize,
-				Concurrency:      optConcurrency,
-				CompressionLevel: gzip.BestCompression,
-			}).Do(context.Background()); err != nil {
-				return
-			}
+		if err = migrateIndex(migrateOptions(index, store, clientES, info, engine)).Do(context.Background()); err != nil {
+			return
 		}
 
-	case optRestore != "":
-		ss := strings.Split(optRestore, "/")
-		if len(ss) != 2 {
-			err = errors.New("参数错误")
+	case optMigratePattern != "":
+		if optOlderThan <= 0 {
+			err = errors.New("-older-than 必须大于 0")
 			return
 		}
-		index, project := strings.TrimSpace(ss[0]), strings.TrimSpace(ss[1])
-		if index == "" || project == "" {
-			err = errors.New("参数缺失")
+		var candidates []tasks.IndexCandidate
+		if candidates, err = tasks.SelectIndices(context.Background(), tasks.IndexSelectOptions{
+			ESClient:   clientES,
+			Storage:    store,
+			Pattern:    optMigratePattern,
+			OlderThan:  time.Duration(optOlderThan) * 24 * time.Hour,
+			DateLayout: optDateLayout,
+		}); err != nil {
 			return
 		}
 
-		if err = checkIndex(index); err != nil {
+		if err = MigrateBatch(context.Background(), candidates, optIndexConcurrency, func(index string) conc.Task {
+			return migrateIndex(migrateOptions(index, store, clientES, info, engine))
+		}); err != nil {
+			return
+		}
+
+	case optRestore != "":
+		if err = checkRestoreMode(optRestoreMode); err != nil {
+			return
+		}
+		if err = checkDeadLetter(optDeadLetter); err != nil {
 			return
 		}
 
-		if err = COSCheckFile(clientCOS, index, project); err != nil {
+		var pairs [][2]string
+		if pairs, err = ResolveRestoreSelectors(context.Background(), store, optRestore); err != nil {
 			return
 		}
 
-		if err = ElasticsearchTouchIndex(clientES, index); err != nil {
+		var bo bulk.Options
+		if bo, err = restoreBulkOptions(); err != nil {
 			return
 		}
 
-		if err = ElasticsearchTuneForRecoveryStart(clientES, index); err != nil {
+		var filter tasks.Filter
+		if filter, err = ParseRestoreFilter(optFilter, optTimestamp, optFilterFrom, optFilterTo); err != nil {
 			return
 		}
-		defer ElasticsearchTuneForRecoveryEnd(clientES, index)
 
-		if err = COSImportToES(clientCOS, index, project, clientES); err != nil {
+		items := make([]*RestoreItem, 0, len(pairs))
+		for _, pair := range pairs {
+			var tpl RestoreTemplate
+			if tpl, err = resolveRestoreTemplate(pair[0]); err != nil {
+				return
+			}
+			items = append(items, &RestoreItem{RestoreOptions: RestoreOptions{
+				Index:         pair[0],
+				Project:       pair[1],
+				Mode:          optRestoreMode,
+				Template:      tpl,
+				Bulk:          bo,
+				DeadLetter:    restoreDeadLetter(),
+				DeadLetterDir: deadLetterDir(),
+				Filter:        filter,
+				VerifyFirst:   optVerifyFirst,
+			}})
+		}
+
+		if err = Restore(context.Background(), items, optConcurrency, store, clientES, info); err != nil {
 			return
 		}
 
 	case optSearch != "":
-		if err = COSSearch(clientCOS, optSearch); err != nil {
+		if err = StorageSearch(context.Background(), store, optSearch); err != nil {
+			return
+		}
+
+	case optVerify != "":
+		if err = VerifySelectors(context.Background(), store, optVerify); err != nil {
+			return
+		}
+
+	case optServe:
+		if err = Serve(store, clientES, info, engine); err != nil {
 			return
 		}
 	}
@@ -0,0 +1,60 @@
+package metrics
+
+import "time"
+
+const (
+	KindIndexMigrate   = "index_migrate"
+	KindProjectRestore = "project_restore"
+	KindPolicy         = "policy"
+
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+var (
+	LatencyBuckets     = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	JobDurationBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+
+	DocumentsExported = Default.NewCounterVec(
+		"esbridge_documents_exported_total", "导出并写入归档的文档数", "index", "project")
+	DocumentsRestored = Default.NewCounterVec(
+		"esbridge_documents_restored_total", "从归档恢复到 Elasticsearch 的文档数", "index", "project")
+	BytesUncompressed = Default.NewCounterVec(
+		"esbridge_bytes_uncompressed_total", "写入归档的未压缩字节数", "index", "project")
+	BytesCompressed = Default.NewCounterVec(
+		"esbridge_bytes_compressed_total", "写入归档的压缩后字节数", "index", "project")
+	BytesUploaded = Default.NewCounterVec(
+		"esbridge_bytes_uploaded_total", "上传到存储的字节数", "index", "project")
+	BytesDownloaded = Default.NewCounterVec(
+		"esbridge_bytes_downloaded_total", "从存储下载的字节数", "index", "project")
+	SearchDuration = Default.NewHistogramVec(
+		"esbridge_search_duration_seconds", "导出时每次 scroll 或 search_after 请求的耗时", LatencyBuckets, "index", "engine")
+	BulkDuration = Default.NewHistogramVec(
+		"esbridge_bulk_duration_seconds", "恢复时每次 bulk 请求的耗时", LatencyBuckets, "index")
+	BulkItemFailures = Default.NewCounterVec(
+		"esbridge_bulk_item_failures_total", "bulk 请求中失败的文档数，包括因冲突跳过的文档", "index", "project", "status")
+	BulkItemRetries = Default.NewCounterVec(
+		"esbridge_bulk_item_retries_total", "bulk 请求中被拒绝或者暂时失败后重试过的文档数", "index", "project")
+	Jobs = Default.NewCounterVec(
+		"esbridge_jobs_total", "任务数，kind 为 index_migrate, project_restore, policy 或者 API 任务类型", "kind", "outcome")
+	JobDuration = Default.NewHistogramVec(
+		"esbridge_job_duration_seconds", "任务耗时", JobDurationBuckets, "kind", "outcome")
+	Migrations = Default.NewCounterVec(
+		"esbridge_index_migrations_total", "索引迁移次数", "index", "outcome")
+	Restores = Default.NewCounterVec(
+		"esbridge_project_restores_total", "项目恢复次数", "index", "project", "outcome")
+)
+
+// Outcome 根据错误返回任务结果
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailed
+	}
+	return OutcomeSucceeded
+}
+
+// ObserveJob 记录任务的结果和耗时
+func ObserveJob(kind string, outcome string, d time.Duration) {
+	Jobs.With(kind, outcome).Inc()
+	JobDuration.With(kind, outcome).Observe(d.Seconds())
+}
@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry 保存所有指标，按 Prometheus 文本格式输出
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write 按名称顺序以文本格式输出所有指标
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	ms := append([]metric{}, r.metrics...)
+	r.lock.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(rw)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(n)
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra[i])
+		sb.WriteString(`="`)
+		sb.WriteString(extra[i+1])
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec 按标签值保存的一组序列
+type vec struct {
+	lock   sync.Mutex
+	n      string
+	help   string
+	typ    string
+	labels []string
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	lock   sync.Mutex
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (v *vec) name() string {
+	return v.n
+}
+
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.n + " 标签数量不正确")
+	}
+	key := strings.Join(values, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s := v.series[key]
+	if s == nil {
+		s = &series{values: append([]string{}, values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) sorted() []*series {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	out := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].values, "\xff") < strings.Join(out[j].values, "\xff")
+	})
+	return out
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	_, _ = w.WriteString("# HELP " + v.n + " " + v.help + "\n")
+	_, _ = w.WriteString("# TYPE " + v.n + " " + v.typ + "\n")
+}
+
+type CounterVec struct {
+	vec
+}
+
+// Counter 单调递增的计数器
+type Counter struct {
+	s *series
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{n: name, help: help, typ: "counter", labels: labels, series: map[string]*series{}}}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) With(values ...string) Counter {
+	return Counter{c.get(values)}
+}
+
+func (c Counter) Add(v float64) {
+	if c.s == nil || v <= 0 {
+		return
+	}
+	c.s.lock.Lock()
+	c.s.value += v
+	c.s.lock.Unlock()
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	for _, s := range c.sorted() {
+		s.lock.Lock()
+		v := s.value
+		s.lock.Unlock()
+		_, _ = w.WriteString(c.n + formatLabels(c.labels, s.values) + " " + formatFloat(v) + "\n")
+	}
+}
+
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// Histogram 按区间统计的观测值
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: vec{n: name, help: help, typ: "histogram", labels: labels, series: map[string]*series{}}, buckets: buckets}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{s: h.get(values), buckets: h.buckets}
+}
+
+func (h Histogram) Observe(v float64) {
+	if h.s == nil {
+		return
+	}
+	h.s.lock.Lock()
+	defer h.s.lock.Unlock()
+	if h.s.counts == nil {
+		h.s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			h.s.counts[i]++
+		}
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	for _, s := range h.sorted() {
+		s.lock.Lock()
+		counts, sum, count := append([]uint64{}, s.counts...), s.sum, s.count
+		s.lock.Unlock()
+		for i, b := range h.buckets {
+			var c uint64
+			if i < len(counts) {
+				c = counts[i]
+			}
+			_, _ = w.WriteString(h.n + "_bucket" + formatLabels(h.labels, s.values, "le", formatFloat(b)) + " " + strconv.FormatUint(c, 10) + "\n")
+		}
+		_, _ = w.WriteString(h.n + "_bucket" + formatLabels(h.labels, s.values, "le", "+Inf") + " " + strconv.FormatUint(count, 10) + "\n")
+		_, _ = w.WriteString(h.n + "_sum" + formatLabels(h.labels, s.values) + " " + formatFloat(sum) + "\n")
+		_, _ = w.WriteString(h.n + "_count" + formatLabels(h.labels, s.values) + " " + strconv.FormatUint(count, 10) + "\n")
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounterVec("test_total", "help", "index")
+	c.With(`a"b`).Add(2)
+	c.With("a").Inc()
+	c.With("a").Add(-1)
+	h := r.NewHistogramVec("test_seconds", "help", []float64{1, 5})
+	h.With().Observe(0.5)
+	h.With().Observe(3)
+	h.With().Observe(10)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, r.Write(buf))
+	assert.Equal(t, `# HELP test_seconds help
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 13.5
+test_seconds_count 3
+# HELP test_total help
+# TYPE test_total counter
+test_total{index="a"} 1
+test_total{index="a\"b"} 2
+`, buf.String())
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶，容量为一秒的令牌数，rate <= 0 时不限制，可以在运行时修改速率
+//
+// 一次请求超过剩余的令牌时会预支，之后的请求需要等待令牌补足
+type Limiter struct {
+	lock    sync.Mutex
+	rate    float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+	now     func() time.Time
+}
+
+func New(rate float64) *Limiter {
+	l := &Limiter{changed: make(chan struct{}), now: time.Now}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *Limiter) Rate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// SetRate 修改速率，正在等待的请求立即返回
+func (l *Limiter) SetRate(rate float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = rate
+	l.last = l.now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// reserve 取出 n 个令牌，返回需要等待的时间
+func (l *Limiter) reserve(n float64) (time.Duration, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0, l.changed
+	}
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0, l.changed
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), l.changed
+}
+
+// WaitN 等待 n 个令牌
+func (l *Limiter) WaitN(ctx context.Context, n int64) error {
+	d, changed := l.reserve(float64(n))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+		return nil
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &Limiter{changed: make(chan struct{}), now: func() time.Time { return now }}
+	l.SetRate(10)
+
+	// 容量为一秒的令牌
+	d, _ := l.reserve(10)
+	assert.Equal(t, time.Duration(0), d)
+	d, _ = l.reserve(5)
+	assert.Equal(t, 500*time.Millisecond, d)
+
+	now = now.Add(time.Second)
+	d, _ = l.reserve(5)
+	assert.Equal(t, time.Duration(0), d)
+
+	l.SetRate(0)
+	d, _ = l.reserve(1000000)
+	assert.Equal(t, time.Duration(0), d)
+}
+
+func TestLimiterWaitN(t *testing.T) {
+	l := New(100)
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		assert.NoError(t, l.WaitN(context.Background(), 10))
+	}
+	// 100 个令牌立即可用，之后 50 个需要 0.5 秒
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+
+	// 修改速率后正在等待的请求立即返回
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.SetRate(0)
+	}()
+	start = time.Now()
+	assert.NoError(t, l.WaitN(context.Background(), 1000))
+	assert.NoError(t, l.WaitN(context.Background(), 1000))
+	assert.True(t, time.Since(start) < time.Second)
+
+	l.SetRate(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, l.WaitN(ctx, 1))
+	assert.Equal(t, context.DeadlineExceeded, l.WaitN(ctx, 1))
+}
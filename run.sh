@@ -2,4 +2,8 @@
 
 set -eu
 
+if [ -n "${ESBRIDGE_PATTERN:-}" ]; then
+  exec /esbridge -migrate-pattern "$ESBRIDGE_PATTERN" -older-than "${ESBRIDGE_OLDER_THAN:-30}" -batch-size "$ESBRIDGE_BATCH_SIZE"
+fi
+
 exec /esbridge -migrate "$ESBRIDGE_INDEX" -batch-size "$ESBRIDGE_BATCH_SIZE"
@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 标准的五段 cron 表达式: 分 时 日 月 周
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny 和 dowAny 用于日和周同时指定时的判断
+	domAny, dowAny bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse 解析 cron 表达式，支持 *, 列表, 范围, 步长和 @daily 等宏
+func Parse(expr string) (s Schedule, err error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := macros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		err = errors.New("cron 表达式需要 5 个字段: " + expr)
+		return
+	}
+	if s.minute, _, err = parseField(fields[0], 0, 59); err != nil {
+		return
+	}
+	if s.hour, _, err = parseField(fields[1], 0, 23); err != nil {
+		return
+	}
+	if s.dom, s.domAny, err = parseField(fields[2], 1, 31); err != nil {
+		return
+	}
+	if s.month, _, err = parseField(fields[3], 1, 12); err != nil {
+		return
+	}
+	if s.dow, s.dowAny, err = parseField(fields[4], 0, 7); err != nil {
+		return
+	}
+	// 7 和 0 都表示周日
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return
+}
+
+func parseField(field string, min, max int) (bits uint64, any bool, err error) {
+	any = field == "*" || field == "?"
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				err = errors.New("无效的步长: " + part)
+				return
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			ss := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(ss[0]); err != nil {
+				return
+			}
+			if hi, err = strconv.Atoi(ss[1]); err != nil {
+				return
+			}
+		default:
+			if lo, err = strconv.Atoi(part); err != nil {
+				return
+			}
+			hi = lo
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			err = errors.New("超出范围: " + part)
+			return
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (s Schedule) matchDay(t time.Time) bool {
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	// 与 cron 一致，日和周都指定时满足其一即可
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next 返回晚于 t 的下一个执行时间，五年内没有匹配时返回零值
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,45 @@
+package schedule
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "0 2 * * *", "*/15 1-5 1,15 * 1-5", "@daily", "0 0 * * 7"} {
+		_, err := Parse(expr)
+		assert.NoError(t, err, expr)
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestNext(t *testing.T) {
+	base := time.Date(2020, 1, 31, 10, 30, 20, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 31, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2020, 2, 1, 2, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 0 30 * *", time.Date(2020, 3, 30, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// 2020-02-02 为周日
+		{"0 0 * * 0", time.Date(2020, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 2, 2, 0, 0, 0, 0, time.UTC)},
+		// 日和周都指定时满足其一即可
+		{"0 0 15 * 6", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.next, s.Next(base), c.expr)
+	}
+	s, _ := Parse("0 0 31 2 *")
+	assert.True(t, s.Next(base).IsZero())
+}
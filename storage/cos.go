@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+)
+
+const (
+	cosDefaultStorageClass = "STANDARD_IA"
+)
+
+type COSOptions struct {
+	URL          string
+	SecretID     string
+	SecretKey    string
+	StorageClass string
+}
+
+type cosStorage struct {
+	client       *cos.Client
+	storageClass string
+}
+
+func NewCOS(opts COSOptions) (Storage, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.StorageClass == "" {
+		opts.StorageClass = cosDefaultStorageClass
+	}
+	return &cosStorage{
+		client: cos.NewClient(&cos.BaseURL{BucketURL: u}, &http.Client{
+			Transport: &cos.AuthorizationTransport{SecretID: opts.SecretID, SecretKey: opts.SecretKey},
+		}),
+		storageClass: opts.StorageClass,
+	}, nil
+}
+
+func (s *cosStorage) headerOptions(opts PutOptions) *cos.ObjectPutHeaderOptions {
+	if opts.StorageClass == "" {
+		opts.StorageClass = s.storageClass
+	}
+	return &cos.ObjectPutHeaderOptions{XCosStorageClass: opts.StorageClass}
+}
+
+func (s *cosStorage) Put(ctx context.Context, key string, file string, opts PutOptions) (err error) {
+	_, _, err = s.client.Object.Upload(ctx, key, file, &cos.MultiUploadOptions{
+		PartSize:       1000,
+		ThreadPoolSize: runtime.NumCPU(),
+		OptIni: &cos.InitiateMultipartUploadOptions{
+			ObjectPutHeaderOptions: s.headerOptions(opts),
+		},
+	})
+	return
+}
+
+func (s *cosStorage) PutStream(ctx context.Context, key string, r io.Reader, opts PutOptions) (err error) {
+	// 先读取第一个分块，数据较小时直接使用单次上传
+	first := make([]byte, DefaultPartSize)
+	var n int
+	if n, err = io.ReadFull(r, first); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			_, err = s.client.Object.Put(ctx, key, bytes.NewReader(first[:n]), &cos.ObjectPutOptions{
+				ObjectPutHeaderOptions: s.headerOptions(opts),
+			})
+		}
+		return
+	}
+	return putStreamMultipart(ctx, s, key, io.MultiReader(bytes.NewReader(first), r), opts, DefaultPartSize)
+}
+
+func (s *cosStorage) Get(ctx context.Context, key string, offset int64, length int64) (rc io.ReadCloser, err error) {
+	var opts *cos.ObjectGetOptions
+	if offset > 0 || length > 0 {
+		opts = &cos.ObjectGetOptions{Range: formatRange(offset, length)}
+	}
+	var res *cos.Response
+	if res, err = s.client.Object.Get(ctx, key, opts); err != nil {
+		if cos.IsNotFoundError(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	rc = res.Body
+	return
+}
+
+func (s *cosStorage) Head(ctx context.Context, key string) (obj Object, err error) {
+	var res *cos.Response
+	if res, err = s.client.Object.Head(ctx, key, nil); err != nil {
+		if cos.IsNotFoundError(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	obj = Object{Key: key, Size: res.ContentLength}
+	return
+}
+
+func (s *cosStorage) List(ctx context.Context, prefix string, fn func(obj Object) error) (err error) {
+	var marker string
+	var res *cos.BucketGetResult
+	for {
+		if res, _, err = s.client.Bucket.Get(ctx, &cos.BucketGetOptions{
+			Prefix: prefix,
+			Marker: marker,
+		}); err != nil {
+			return
+		}
+		for _, o := range res.Contents {
+			if err = fn(Object{Key: o.Key, Size: int64(o.Size)}); err != nil {
+				return
+			}
+		}
+		if !res.IsTruncated {
+			return
+		}
+		if res.NextMarker == "" {
+			err = errors.New("腾讯云存储返回的 NextMarker 为空")
+			return
+		}
+		marker = res.NextMarker
+	}
+}
+
+func (s *cosStorage) Delete(ctx context.Context, key string) (err error) {
+	_, err = s.client.Object.Delete(ctx, key)
+	return
+}
+
+func formatRange(offset int64, length int64) string {
+	if length <= 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+func (s *cosStorage) CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (uploadID string, err error) {
+	var res *cos.InitiateMultipartUploadResult
+	if res, _, err = s.client.Object.InitiateMultipartUpload(ctx, key, &cos.InitiateMultipartUploadOptions{
+		ObjectPutHeaderOptions: s.headerOptions(opts),
+	}); err != nil {
+		return
+	}
+	uploadID = res.UploadID
+	return
+}
+
+func (s *cosStorage) UploadPart(ctx context.Context, key string, uploadID string, number int, data []byte) (part Part, err error) {
+	var res *cos.Response
+	if res, err = s.client.Object.UploadPart(ctx, key, uploadID, number, bytes.NewReader(data), nil); err != nil {
+		return
+	}
+	part = Part{Number: number, ETag: res.Header.Get("ETag"), Size: int64(len(data))}
+	return
+}
+
+func (s *cosStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (err error) {
+	opts := &cos.CompleteMultipartUploadOptions{}
+	for _, p := range parts {
+		opts.Parts = append(opts.Parts, cos.Object{PartNumber: p.Number, ETag: p.ETag})
+	}
+	_, _, err = s.client.Object.CompleteMultipartUpload(ctx, key, uploadID, opts)
+	return
+}
+
+func (s *cosStorage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) (err error) {
+	_, err = s.client.Object.AbortMultipartUpload(ctx, key, uploadID)
+	return
+}
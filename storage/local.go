@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	localTempPattern = ".esbridge-tmp-"
+)
+
+type LocalOptions struct {
+	Dir string
+}
+
+type localStorage struct {
+	dir string
+}
+
+// NewLocal 创建本地目录存储，可用于挂载的 NFS 等目录
+func NewLocal(opts LocalOptions) (Storage, error) {
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (s *localStorage) filename(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", errors.New("无效的对象名称: " + key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, file string, opts PutOptions) (err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	return s.PutStream(ctx, key, f, opts)
+}
+
+// PutStream 先写入同目录下的临时文件，完成后再重命名，保证不会出现写了一半的文件
+func (s *localStorage) PutStream(ctx context.Context, key string, r io.Reader, opts PutOptions) (err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+localTempPattern); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err = io.Copy(f, &contextReader{ctx: ctx, r: r}); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), name); err != nil {
+		return
+	}
+	return
+}
+
+func (s *localStorage) Get(ctx context.Context, key string, offset int64, length int64) (rc io.ReadCloser, err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(name); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	if offset > 0 {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return
+		}
+	}
+	if length > 0 {
+		rc = &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}
+	} else {
+		rc = f
+	}
+	return
+}
+
+func (s *localStorage) Head(ctx context.Context, key string) (obj Object, err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	if fi.IsDir() {
+		err = ErrNotFound
+		return
+	}
+	obj = Object{Key: key, Size: fi.Size()}
+	return
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string, fn func(obj Object) error) (err error) {
+	var objs []Object
+	if err = filepath.Walk(s.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.Contains(fi.Name(), localTempPattern) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objs = append(objs, Object{Key: key, Size: fi.Size()})
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Key < objs[j].Key
+	})
+	for _, obj := range objs {
+		if err = fn(obj); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) (err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	if err = os.Remove(name); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return
+}
+
+// uploadDir 分块上传时，各分块保存在目标文件同目录下的临时目录中
+func (s *localStorage) uploadDir(key string, uploadID string) (dir string, err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	if uploadID == "" || strings.ContainsAny(uploadID, "/\\.") {
+		err = errors.New("无效的上传 ID: " + uploadID)
+		return
+	}
+	dir = name + localTempPattern + uploadID
+	return
+}
+
+func (s *localStorage) CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (uploadID string, err error) {
+	var name string
+	if name, err = s.filename(key); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	var dir string
+	if dir, err = ioutil.TempDir(filepath.Dir(name), filepath.Base(name)+localTempPattern); err != nil {
+		return
+	}
+	uploadID = strings.TrimPrefix(filepath.Base(dir), filepath.Base(name)+localTempPattern)
+	return
+}
+
+func (s *localStorage) UploadPart(ctx context.Context, key string, uploadID string, number int, data []byte) (part Part, err error) {
+	var dir string
+	if dir, err = s.uploadDir(key, uploadID); err != nil {
+		return
+	}
+	partName := filepath.Join(dir, fmt.Sprintf("%05d", number))
+	if err = ioutil.WriteFile(partName+localTempPattern, data, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(partName+localTempPattern, partName); err != nil {
+		return
+	}
+	part = Part{Number: number, ETag: fmt.Sprintf("%05d", number), Size: int64(len(data))}
+	return
+}
+
+func (s *localStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (err error) {
+	var dir string
+	if dir, err = s.uploadDir(key, uploadID); err != nil {
+		return
+	}
+	var readers []io.Reader
+	for _, p := range parts {
+		var f *os.File
+		if f, err = os.Open(filepath.Join(dir, fmt.Sprintf("%05d", p.Number))); err != nil {
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if err = s.PutStream(ctx, key, io.MultiReader(readers...), PutOptions{}); err != nil {
+		return
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *localStorage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) (err error) {
+	var dir string
+	if dir, err = s.uploadDir(key, uploadID); err != nil {
+		return
+	}
+	return os.RemoveAll(dir)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
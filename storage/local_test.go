@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbridge-local-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocal(LocalOptions{Dir: dir})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, s.PutStream(ctx, "index-a/project-a.ndjson.gz", bytes.NewReader([]byte("0123456789")), PutOptions{}))
+	assert.NoError(t, s.PutStream(ctx, "index-b/project-b.ndjson.gz", bytes.NewReader([]byte("hello")), PutOptions{}))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index-a", "project-c.ndjson.gz"+localTempPattern+"123"), []byte("half"), 0644))
+
+	obj, err := s.Head(ctx, "index-a/project-a.ndjson.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), obj.Size)
+
+	_, err = s.Head(ctx, "index-a/missing.ndjson.gz")
+	assert.Equal(t, ErrNotFound, err)
+
+	rc, err := s.Get(ctx, "index-a/project-a.ndjson.gz", 2, 3)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, "234", string(buf))
+
+	var keys []string
+	assert.NoError(t, s.List(ctx, "index-a/", func(obj Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"index-a/project-a.ndjson.gz"}, keys)
+
+	assert.NoError(t, s.Delete(ctx, "index-a/project-a.ndjson.gz"))
+	_, err = s.Head(ctx, "index-a/project-a.ndjson.gz")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Error(t, s.PutStream(ctx, "../escape", bytes.NewReader(nil), PutOptions{}))
+}
+
+func TestLocalStorageMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbridge-local-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocal(LocalOptions{Dir: dir})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	u := NewUploader(s, "index-a/project-a.ndjson.gz", UploaderOptions{})
+	assert.NoError(t, u.Start(ctx))
+	assert.NoError(t, u.UploadPart(ctx, []byte("hello ")))
+	assert.NoError(t, u.UploadPart(ctx, []byte("world")))
+
+	var keys []string
+	assert.NoError(t, s.List(ctx, "", func(obj Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	assert.Empty(t, keys)
+
+	assert.NoError(t, u.Complete(ctx))
+	assert.Equal(t, int64(11), u.Size())
+
+	rc, err := s.Get(ctx, "index-a/project-a.ndjson.gz", 0, 0)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, "hello world", string(buf))
+
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "index-a"))
+	assert.NoError(t, err)
+	assert.Len(t, fis, 1)
+}
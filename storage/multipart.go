@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/guoyk93/esbridge/joblog"
+	"io"
+	"time"
+)
+
+const (
+	DefaultPartSize    = 16 * 1024 * 1024
+	DefaultPartRetries = 5
+	// MinPartSize S3 要求除最后一个以外的分块不小于 5MB
+	MinPartSize = 5 * 1024 * 1024
+)
+
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+type UploaderOptions struct {
+	PutOptions
+	// Retries 单个分块上传失败后的重试次数
+	Retries int
+}
+
+// Uploader 分块上传，每次只持有一个分块的数据，分块失败时单独重试
+type Uploader struct {
+	storage  Storage
+	key      string
+	opts     UploaderOptions
+	uploadID string
+	parts    []Part
+}
+
+func NewUploader(s Storage, key string, opts UploaderOptions) *Uploader {
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	return &Uploader{storage: s, key: key, opts: opts}
+}
+
+// ResumeUploader 继续之前未完成的分块上传
+func ResumeUploader(s Storage, key string, uploadID string, parts []Part, opts UploaderOptions) *Uploader {
+	u := NewUploader(s, key, opts)
+	u.uploadID = uploadID
+	u.parts = append([]Part{}, parts...)
+	return u
+}
+
+func (u *Uploader) Key() string {
+	return u.key
+}
+
+func (u *Uploader) UploadID() string {
+	return u.uploadID
+}
+
+func (u *Uploader) Parts() []Part {
+	return append([]Part{}, u.parts...)
+}
+
+func (u *Uploader) Size() (size int64) {
+	for _, p := range u.parts {
+		size += p.Size
+	}
+	return
+}
+
+func (u *Uploader) Start(ctx context.Context) (err error) {
+	u.parts = nil
+	u.uploadID, err = u.storage.CreateMultipartUpload(ctx, u.key, u.opts.PutOptions)
+	return
+}
+
+func (u *Uploader) UploadPart(ctx context.Context, data []byte) (err error) {
+	number := len(u.parts) + 1
+	var part Part
+	for i := 0; ; i++ {
+		if part, err = u.storage.UploadPart(ctx, u.key, u.uploadID, number, data); err == nil {
+			break
+		}
+		if i >= u.opts.Retries || ctx.Err() != nil {
+			err = fmt.Errorf("上传分块失败: %s #%d: %s", u.key, number, err.Error())
+			return
+		}
+		wait := time.Second << uint(i)
+		joblog.Printf(ctx, "上传分块失败，%s 后重试: %s #%d: %s", wait, u.key, number, err.Error())
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(wait):
+		}
+	}
+	u.parts = append(u.parts, part)
+	return
+}
+
+func (u *Uploader) Complete(ctx context.Context) error {
+	return u.storage.CompleteMultipartUpload(ctx, u.key, u.uploadID, u.parts)
+}
+
+func (u *Uploader) Abort(ctx context.Context) error {
+	if u.uploadID == "" {
+		return nil
+	}
+	return u.storage.AbortMultipartUpload(ctx, u.key, u.uploadID)
+}
+
+// putStreamMultipart 将数据流按照 partSize 切分后通过 Uploader 上传，至少上传一个分块
+func putStreamMultipart(ctx context.Context, s Storage, key string, r io.Reader, opts PutOptions, partSize int64) (err error) {
+	u := NewUploader(s, key, UploaderOptions{PutOptions: opts, Retries: DefaultPartRetries})
+	if err = u.Start(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = u.Abort(context.Background())
+		}
+	}()
+	buf := make([]byte, partSize)
+	for {
+		var n int
+		if n, err = io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			} else {
+				return
+			}
+		}
+		if n > 0 || len(u.parts) == 0 {
+			if err = u.UploadPart(ctx, buf[:n]); err != nil {
+				return
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return u.Complete(ctx)
+}
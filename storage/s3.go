@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultPartSize = 16 * 1024 * 1024
+	s3MinPartSize     = 5 * 1024 * 1024
+)
+
+type S3Options struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle 使用 ENDPOINT/BUCKET/KEY 形式的地址，MinIO 和 Ceph RGW 通常需要开启
+	PathStyle    bool
+	StorageClass string
+	PartSize     int64
+}
+
+type s3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	pathStyle    bool
+	storageClass string
+	partSize     int64
+	signer       sigV4Signer
+	client       *http.Client
+}
+
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	RequestID  string `xml:"RequestId"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 请求失败: %d %s: %s (%s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+func NewS3(opts S3Options) (Storage, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("无效的 S3 地址: %s", opts.Endpoint)
+	}
+	if opts.Region == "" {
+		opts.Region = s3DefaultRegion
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = s3DefaultPartSize
+	}
+	if opts.PartSize < s3MinPartSize {
+		opts.PartSize = s3MinPartSize
+	}
+	return &s3Storage{
+		endpoint:     u,
+		bucket:       opts.Bucket,
+		pathStyle:    opts.PathStyle,
+		storageClass: opts.StorageClass,
+		partSize:     opts.PartSize,
+		signer: sigV4Signer{
+			AccessKeyID:     opts.AccessKeyID,
+			SecretAccessKey: opts.SecretAccessKey,
+			Region:          opts.Region,
+			Service:         "s3",
+		},
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *s3Storage) buildURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		basePath = basePath + "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = basePath + "/" + key
+	u.RawPath = sigV4Escape(basePath, true) + "/" + sigV4Escape(key, true)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return &u
+}
+
+func (s *s3Storage) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (res *http.Response, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(method, s.buildURL(key, query).String(), bytes.NewReader(body)); err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := sigV4EmptySHA256
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	s.signer.Sign(req, payloadHash, time.Now())
+
+	if res, err = s.client.Do(req); err != nil {
+		return
+	}
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound && (method == http.MethodGet || method == http.MethodHead) && query.Get("uploadId") == "" {
+		err = ErrNotFound
+		return
+	}
+	e := &s3Error{StatusCode: res.StatusCode}
+	if buf, _ := ioutil.ReadAll(res.Body); len(buf) > 0 {
+		_ = xml.Unmarshal(buf, e)
+	}
+	err = e
+	return
+}
+
+func (s *s3Storage) doXML(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte, out interface{}) (err error) {
+	var res *http.Response
+	if res, err = s.do(ctx, method, key, query, header, body); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	var buf []byte
+	if buf, err = ioutil.ReadAll(res.Body); err != nil {
+		return
+	}
+	if out != nil {
+		if err = xml.Unmarshal(buf, out); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *s3Storage) headerStorageClass(opts PutOptions) http.Header {
+	h := http.Header{}
+	if opts.StorageClass == "" {
+		opts.StorageClass = s.storageClass
+	}
+	if opts.StorageClass != "" {
+		h.Set("x-amz-storage-class", opts.StorageClass)
+	}
+	return h
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, file string, opts PutOptions) (err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	return s.PutStream(ctx, key, f, opts)
+}
+
+func (s *s3Storage) PutStream(ctx context.Context, key string, r io.Reader, opts PutOptions) (err error) {
+	// 先读取第一个分块，数据较小时直接使用单次上传
+	first := make([]byte, s.partSize)
+	var n int
+	if n, err = io.ReadFull(r, first); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			var res *http.Response
+			if res, err = s.do(ctx, http.MethodPut, key, nil, s.headerStorageClass(opts), first[:n]); err != nil {
+				return
+			}
+			res.Body.Close()
+		}
+		return
+	}
+
+	return putStreamMultipart(ctx, s, key, io.MultiReader(bytes.NewReader(first), r), opts, s.partSize)
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string, offset int64, length int64) (rc io.ReadCloser, err error) {
+	header := http.Header{}
+	if offset > 0 || length > 0 {
+		header.Set("Range", formatRange(offset, length))
+	}
+	var res *http.Response
+	if res, err = s.do(ctx, http.MethodGet, key, nil, header, nil); err != nil {
+		return
+	}
+	rc = res.Body
+	return
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (obj Object, err error) {
+	var res *http.Response
+	if res, err = s.do(ctx, http.MethodHead, key, nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+	obj = Object{Key: key, Size: res.ContentLength}
+	return
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(obj Object) error) (err error) {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": []string{"2"},
+			"prefix":    []string{prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var res struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key  string `xml:"Key"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		if err = s.doXML(ctx, http.MethodGet, "", query, nil, nil, &res); err != nil {
+			return
+		}
+		for _, o := range res.Contents {
+			if err = fn(Object{Key: o.Key, Size: o.Size}); err != nil {
+				return
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) (err error) {
+	var res *http.Response
+	if res, err = s.do(ctx, http.MethodDelete, key, nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+	return
+}
+
+func (s *s3Storage) CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (uploadID string, err error) {
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = s.doXML(ctx, http.MethodPost, key, url.Values{"uploads": []string{""}}, s.headerStorageClass(opts), nil, &res); err != nil {
+		return
+	}
+	uploadID = res.UploadID
+	return
+}
+
+func (s *s3Storage) UploadPart(ctx context.Context, key string, uploadID string, number int, data []byte) (part Part, err error) {
+	var res *http.Response
+	if res, err = s.do(ctx, http.MethodPut, key, url.Values{
+		"partNumber": []string{strconv.Itoa(number)},
+		"uploadId":   []string{uploadID},
+	}, nil, data); err != nil {
+		return
+	}
+	res.Body.Close()
+	part = Part{Number: number, ETag: res.Header.Get("ETag"), Size: int64(len(data))}
+	return
+}
+
+func (s *s3Storage) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (err error) {
+	type completePart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var complete struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for _, p := range parts {
+		complete.Parts = append(complete.Parts, completePart{PartNumber: p.Number, ETag: p.ETag})
+	}
+	var body []byte
+	if body, err = xml.Marshal(complete); err != nil {
+		return
+	}
+	// CompleteMultipartUpload 可能在 200 响应中返回错误
+	var res struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err = s.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": []string{uploadID}}, nil, body, &res); err != nil {
+		return
+	}
+	if res.XMLName.Local == "Error" {
+		err = &s3Error{StatusCode: http.StatusOK, Code: res.Code, Message: res.Message}
+		return
+	}
+	return
+}
+
+func (s *s3Storage) AbortMultipartUpload(ctx context.Context, key string, uploadID string) (err error) {
+	var res *http.Response
+	if res, err = s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": []string{uploadID}}, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+	return
+}
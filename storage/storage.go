@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound = errors.New("对象不存在")
+)
+
+type Object struct {
+	Key  string
+	Size int64
+}
+
+type PutOptions struct {
+	// StorageClass 存储类型，留空时使用存储后端的默认值
+	StorageClass string
+}
+
+type Storage interface {
+	// Put 上传本地文件
+	Put(ctx context.Context, key string, file string, opts PutOptions) error
+	// PutStream 上传数据流，长度未知
+	PutStream(ctx context.Context, key string, r io.Reader, opts PutOptions) error
+	// Get 读取对象，length <= 0 时读取到末尾
+	Get(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+	// Head 获取对象信息，不存在时返回 ErrNotFound
+	Head(ctx context.Context, key string) (Object, error)
+	// List 列出指定前缀的所有对象
+	List(ctx context.Context, prefix string, fn func(obj Object) error) error
+	// Delete 删除对象
+	Delete(ctx context.Context, key string) error
+
+	// CreateMultipartUpload 开始分块上传，返回上传 ID
+	CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (string, error)
+	// UploadPart 上传一个分块，除最后一个分块外，分块大小需满足存储后端的最小值
+	UploadPart(ctx context.Context, key string, uploadID string, number int, data []byte) (Part, error)
+	// CompleteMultipartUpload 按顺序合并所有分块
+	CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) error
+	// AbortMultipartUpload 放弃分块上传
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+}
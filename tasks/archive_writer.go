@@ -0,0 +1,195 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
+	gzip "github.com/klauspost/pgzip"
+	"sync"
+)
+
+// archiveWriter 将文档压缩后直接分块上传到存储，不经过本地工作目录
+//
+// 每个分块都是一个完整的 gzip 成员，多个 gzip 成员拼接后依然是合法的 gzip 文件，
+// 因此可以在任意一个分块之后，根据记录的游标继续导出
+type archiveWriter struct {
+	// lock 多个切片会并发写入同一个项目
+	lock     sync.Mutex
+	project  string
+	uploader *storage.Uploader
+	partSize int64
+	buf      *bytes.Buffer
+	zw       *gzip.Writer
+	store    *checkpointStore
+	cursors  [][]interface{}
+	docs     int64
+	// stats 为已上传分块的统计，pending 为当前分块中文档的统计
+	stats   *statsRecorder
+	pending *statsRecorder
+	// uploaded 已上传字节数的监控指标
+	uploaded metrics.Counter
+}
+
+func newArchiveWriter(ctx context.Context, opts ProjectMigrateOptions, store *checkpointStore) (w *archiveWriter, err error) {
+	uOpts := storage.UploaderOptions{
+		PutOptions: storage.PutOptions{StorageClass: opts.StorageClass},
+		Retries:    opts.PartRetries,
+	}
+	w = &archiveWriter{
+		project:  opts.Project,
+		uploader: storage.NewUploader(opts.Storage, opts.FilenameRemote(), uOpts),
+		partSize: opts.PartSize,
+		buf:      &bytes.Buffer{},
+		store:    store,
+		stats:    newStatsRecorder(opts.FilenameRemote(), opts.timestampField()),
+		pending:  newStatsRecorder(opts.FilenameRemote(), opts.timestampField()),
+		uploaded: metrics.BytesUploaded.With(opts.Index, opts.Project),
+	}
+	if w.partSize <= 0 {
+		w.partSize = storage.DefaultPartSize
+	}
+	if w.zw, err = gzip.NewWriterLevel(w.buf, opts.CompressionLevel); err != nil {
+		return
+	}
+	if store != nil {
+		p := store.Project(opts.Project)
+		if p.UploadID != "" {
+			if opts.resumable() && len(p.Parts) > 0 && len(p.Cursors) == opts.slices() {
+				joblog.Printf(ctx, "继续分块上传: %s/%s, 已上传 %d 个分块", opts.Index, opts.Project, len(p.Parts))
+				w.uploader = storage.ResumeUploader(opts.Storage, opts.FilenameRemote(), p.UploadID, p.Parts, uOpts)
+				w.cursors = p.Cursors
+				if p.Stats != nil {
+					if w.stats, err = restoreStatsRecorder(opts.timestampField(), *p.Stats, p.HashState); err != nil {
+						return
+					}
+				}
+				return
+			}
+			joblog.Printf(ctx, "无法继续分块上传，重新导出: %s/%s", opts.Index, opts.Project)
+			if err := opts.Storage.AbortMultipartUpload(ctx, opts.FilenameRemote(), p.UploadID); err != nil {
+				joblog.Printf(ctx, "放弃分块上传失败: %s/%s: %s", opts.Index, opts.Project, err.Error())
+			}
+			store.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+				*p = ProjectCheckpoint{}
+			})
+		}
+	}
+	if err = w.uploader.Start(ctx); err != nil {
+		return
+	}
+	if store != nil {
+		store.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+			p.UploadID = w.uploader.UploadID()
+		})
+		if err = store.Save(ctx); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Cursors 继续导出时每个切片的起始游标
+func (w *archiveWriter) Cursors() [][]interface{} {
+	return w.cursors
+}
+
+func (w *archiveWriter) flush(ctx context.Context) (err error) {
+	if err = w.zw.Close(); err != nil {
+		return
+	}
+	if err = w.uploader.UploadPart(ctx, w.buf.Bytes()); err != nil {
+		return
+	}
+	w.uploaded.Add(float64(w.buf.Len()))
+	w.stats.Merge(w.pending)
+	_, _ = w.stats.Write(w.buf.Bytes())
+	w.pending = newStatsRecorder(w.stats.Key, w.stats.field)
+	w.buf.Reset()
+	w.zw.Reset(w.buf)
+	if w.store != nil {
+		cursors := append([][]interface{}{}, w.cursors...)
+		var state []byte
+		if state, err = w.stats.HashState(); err != nil {
+			return
+		}
+		stats := w.stats.Manifest()
+		w.store.UpdateProject(w.project, func(p *ProjectCheckpoint) {
+			p.UploadID = w.uploader.UploadID()
+			p.Parts = w.uploader.Parts()
+			p.BytesUploaded = w.uploader.Size()
+			p.Documents += w.docs
+			p.Cursors = cursors
+			p.Stats = stats
+			p.HashState = state
+		})
+		if err = w.store.Save(ctx); err != nil {
+			return
+		}
+	}
+	w.docs = 0
+	return
+}
+
+// Write 写入一行归档记录，source 为文档的 _source，slice 和 cursor 为文档所在的切片和排序值
+func (w *archiveWriter) Write(ctx context.Context, line []byte, source []byte, slice int, cursor []interface{}) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err = w.zw.Write(line); err != nil {
+		return
+	}
+	if _, err = w.zw.Write(newLine); err != nil {
+		return
+	}
+	w.docs++
+	w.pending.AddDocument(line, source)
+	if cursor != nil {
+		for len(w.cursors) <= slice {
+			w.cursors = append(w.cursors, nil)
+		}
+		w.cursors[slice] = cursor
+	}
+	if int64(w.buf.Len()) >= w.partSize {
+		if err = w.flush(ctx); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *archiveWriter) Close(ctx context.Context) (err error) {
+	if err = w.flush(ctx); err != nil {
+		return
+	}
+	if err = w.uploader.Complete(ctx); err != nil {
+		return
+	}
+	if w.store != nil {
+		w.store.UpdateProject(w.project, func(p *ProjectCheckpoint) {
+			p.Done = true
+			p.UploadID = ""
+			p.Parts = nil
+			p.Cursors = nil
+			p.HashState = nil
+		})
+		if err = w.store.Save(ctx); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Manifest 已上传数据的统计
+func (w *archiveWriter) Manifest() *ProjectManifest {
+	return w.stats.Manifest()
+}
+
+// Abort 放弃分块上传，有进度记录时保留已上传的分块以便继续
+func (w *archiveWriter) Abort() {
+	_ = w.zw.Close()
+	if w.store != nil {
+		return
+	}
+	_ = w.uploader.Abort(context.Background())
+}
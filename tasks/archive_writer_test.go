@@ -0,0 +1,119 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/guoyk93/esbridge/storage"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestArchiveWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbridge-archive-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := storage.NewLocal(storage.LocalOptions{Dir: dir})
+	assert.NoError(t, err)
+
+	opts := ProjectMigrateOptions{
+		IndexMigrateOptions: IndexMigrateOptions{
+			Storage:          store,
+			Index:            "index-a",
+			CompressionLevel: gzip.BestSpeed,
+			PartSize:         1,
+		},
+		Project: "project-a",
+	}
+
+	ctx := context.Background()
+	w, err := newArchiveWriter(ctx, opts, nil)
+	assert.NoError(t, err)
+	var expected []string
+	for i := 0; i < 3; i++ {
+		doc := `{"id":` + strconv.Itoa(i) + `}`
+		expected = append(expected, doc)
+		assert.NoError(t, w.Write(ctx, []byte(doc), []byte(doc), 0, nil))
+	}
+	assert.NoError(t, w.Close(ctx))
+
+	rc, err := store.Get(ctx, opts.FilenameRemote(), 0, 0)
+	assert.NoError(t, err)
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(expected, "\n")+"\n", string(buf))
+}
+
+func TestArchiveWriterResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbridge-archive-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := storage.NewLocal(storage.LocalOptions{Dir: filepath.Join(dir, "archive")})
+	assert.NoError(t, err)
+
+	opts := ProjectMigrateOptions{
+		IndexMigrateOptions: IndexMigrateOptions{
+			Storage:          store,
+			Dir:              filepath.Join(dir, "workspace"),
+			Index:            "index-a",
+			CompressionLevel: gzip.BestSpeed,
+			PartSize:         1,
+			Engine:           EnginePIT,
+			Tiebreaker:       "log_id",
+			Slices:           1,
+		},
+		Project: "project-a",
+	}
+
+	ctx := context.Background()
+	cs, err := newCheckpointStore(ctx, opts.IndexMigrateOptions)
+	assert.NoError(t, err)
+	w, err := newArchiveWriter(ctx, opts, cs)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, w.Write(ctx, []byte(`{"id":`+strconv.Itoa(i)+`}`), nil, 0, []interface{}{json.Number(strconv.Itoa(i))}))
+	}
+	w.Abort()
+
+	opts.Resume = true
+	cs, err = newCheckpointStore(ctx, opts.IndexMigrateOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cs.Project("project-a").Documents)
+	w, err = newArchiveWriter(ctx, opts, cs)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{json.Number("1")}}, w.Cursors())
+	assert.NoError(t, w.Write(ctx, []byte(`{"id":2}`), nil, 0, []interface{}{json.Number("2")}))
+	assert.NoError(t, w.Close(ctx))
+	assert.True(t, cs.Project("project-a").Done)
+
+	rc, err := store.Get(ctx, opts.FilenameRemote(), 0, 0)
+	assert.NoError(t, err)
+	defer rc.Close()
+	raw, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":0}\n{\"id\":1}\n{\"id\":2}\n", string(buf))
+
+	pm := cs.Project("project-a").Stats
+	assert.Equal(t, int64(3), pm.Documents)
+	assert.Equal(t, int64(len(buf)), pm.UncompressedBytes)
+	assert.Equal(t, int64(len(raw)), pm.CompressedBytes)
+	sum := sha256.Sum256(raw)
+	assert.Equal(t, hex.EncodeToString(sum[:]), pm.SHA256)
+}
@@ -0,0 +1,203 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FileCheckpoint = "_checkpoint.json"
+)
+
+type ProjectCheckpoint struct {
+	Done          bool  `json:"done"`
+	Exported      bool  `json:"exported,omitempty"`
+	Documents     int64 `json:"documents"`
+	BytesUploaded int64 `json:"bytes_uploaded"`
+	// UploadID 和 Parts 为流式上传中未完成的分块上传
+	UploadID string         `json:"upload_id,omitempty"`
+	Parts    []storage.Part `json:"parts,omitempty"`
+	// Cursors 已上传分块中最后一个文档在每个切片中的排序值
+	Cursors [][]interface{} `json:"cursors,omitempty"`
+	// Stats 和 HashState 为已写入数据的统计，用于生成描述文件
+	Stats     *ProjectManifest `json:"stats,omitempty"`
+	HashState []byte           `json:"hash_state,omitempty"`
+}
+
+type Checkpoint struct {
+	Index     string                        `json:"index"`
+	Engine    string                        `json:"engine"`
+	Slices    int                           `json:"slices"`
+	Sort      []string                      `json:"sort,omitempty"`
+	Stream    bool                          `json:"stream"`
+	Exported  bool                          `json:"exported,omitempty"`
+	Projects  map[string]*ProjectCheckpoint `json:"projects"`
+	UpdatedAt time.Time                     `json:"updated_at"`
+}
+
+func (opts IndexMigrateOptions) FilenameCheckpointLocal() string {
+	return filepath.Join(opts.Workspace(), FileCheckpoint)
+}
+
+func (opts IndexMigrateOptions) FilenameCheckpointRemote() string {
+	return opts.Index + "/" + FileCheckpoint
+}
+
+// checkpointStore 保存迁移进度，同时写入本地工作目录和存储
+type checkpointStore struct {
+	lock sync.Mutex
+	opts IndexMigrateOptions
+	cp   *Checkpoint
+}
+
+func decodeCheckpoint(buf []byte) (cp *Checkpoint, err error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	// 游标中的数字需要保持原样
+	dec.UseNumber()
+	cp = &Checkpoint{}
+	if err = dec.Decode(cp); err != nil {
+		return
+	}
+	if cp.Projects == nil {
+		cp.Projects = map[string]*ProjectCheckpoint{}
+	}
+	return
+}
+
+// loadCheckpoint 从本地工作目录和存储中读取较新的进度，都不存在时返回 nil
+func loadCheckpoint(ctx context.Context, opts IndexMigrateOptions) (cp *Checkpoint, err error) {
+	var local, remote *Checkpoint
+	var buf []byte
+	if buf, err = ioutil.ReadFile(opts.FilenameCheckpointLocal()); err == nil {
+		if local, err = decodeCheckpoint(buf); err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	var rc io.ReadCloser
+	if rc, err = opts.Storage.Get(ctx, opts.FilenameCheckpointRemote(), 0, 0); err == nil {
+		buf, err = ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return
+		}
+		if remote, err = decodeCheckpoint(buf); err != nil {
+			return
+		}
+	} else if err != storage.ErrNotFound {
+		return
+	}
+	err = nil
+	cp = local
+	if cp == nil || (remote != nil && remote.UpdatedAt.After(cp.UpdatedAt)) {
+		cp = remote
+	}
+	return
+}
+
+// newCheckpointStore 创建进度记录，resume 为 false 时放弃之前未完成的分块上传并重新开始
+func newCheckpointStore(ctx context.Context, opts IndexMigrateOptions) (s *checkpointStore, err error) {
+	var prev *Checkpoint
+	if prev, err = loadCheckpoint(ctx, opts); err != nil {
+		return
+	}
+	s = &checkpointStore{opts: opts}
+	if prev != nil && opts.Resume {
+		joblog.Printf(ctx, "从进度文件继续迁移: %s (%s)", opts.Index, prev.UpdatedAt.Format(time.RFC3339))
+		if prev.Engine != opts.Engine || prev.Slices != opts.slices() || prev.Stream != opts.Stream || strings.Join(prev.Sort, ",") != strings.Join(opts.pitSort(), ",") {
+			joblog.Printf(ctx, "导出参数与进度文件不一致，未完成的项目将重新导出")
+			for _, p := range prev.Projects {
+				p.Cursors = nil
+			}
+		}
+		prev.Engine, prev.Slices, prev.Stream, prev.Sort = opts.Engine, opts.slices(), opts.Stream, opts.pitSort()
+		s.cp = prev
+		return
+	}
+	if prev != nil {
+		joblog.Printf(ctx, "放弃之前的迁移进度: %s", opts.Index)
+		for name, p := range prev.Projects {
+			if p.UploadID != "" {
+				if err := opts.Storage.AbortMultipartUpload(ctx, opts.Index+"/"+name+ExtCompressedNDJSON, p.UploadID); err != nil {
+					joblog.Printf(ctx, "放弃分块上传失败: %s/%s: %s", opts.Index, name, err.Error())
+				}
+			}
+		}
+	}
+	s.cp = &Checkpoint{
+		Index:    opts.Index,
+		Engine:   opts.Engine,
+		Slices:   opts.slices(),
+		Sort:     opts.pitSort(),
+		Stream:   opts.Stream,
+		Projects: map[string]*ProjectCheckpoint{},
+	}
+	return
+}
+
+// Update 在锁内修改进度
+func (s *checkpointStore) Update(fn func(cp *Checkpoint)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fn(s.cp)
+}
+
+// Project 获取项目的进度，不存在时创建
+func (s *checkpointStore) Project(name string) (p ProjectCheckpoint) {
+	s.Update(func(cp *Checkpoint) {
+		if cp.Projects[name] == nil {
+			cp.Projects[name] = &ProjectCheckpoint{}
+		}
+		p = *cp.Projects[name]
+	})
+	return
+}
+
+func (s *checkpointStore) UpdateProject(name string, fn func(p *ProjectCheckpoint)) {
+	s.Update(func(cp *Checkpoint) {
+		if cp.Projects[name] == nil {
+			cp.Projects[name] = &ProjectCheckpoint{}
+		}
+		fn(cp.Projects[name])
+	})
+}
+
+func (s *checkpointStore) Save(ctx context.Context) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cp.UpdatedAt = time.Now()
+	var buf []byte
+	if buf, err = json.MarshalIndent(s.cp, "", "  "); err != nil {
+		return
+	}
+	if err = os.MkdirAll(s.opts.Workspace(), 0755); err != nil {
+		return
+	}
+	tmp := s.opts.FilenameCheckpointLocal() + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, s.opts.FilenameCheckpointLocal()); err != nil {
+		return
+	}
+	if err = s.opts.Storage.PutStream(ctx, s.opts.FilenameCheckpointRemote(), bytes.NewReader(buf), storage.PutOptions{}); err != nil {
+		return
+	}
+	return
+}
+
+// Clear 迁移完成后删除存储中的进度文件
+func (s *checkpointStore) Clear(ctx context.Context) error {
+	return s.opts.Storage.Delete(ctx, s.opts.FilenameCheckpointRemote())
+}
@@ -0,0 +1,126 @@
+package tasks
+
+import (
+	"context"
+	"github.com/guoyk93/conc"
+	"github.com/guoyk93/esbridge/exporter"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/logutil"
+	"github.com/olivere/elastic"
+	"sync"
+	"time"
+)
+
+const (
+	EngineScroll = "scroll"
+	EnginePIT    = "pit"
+
+	exportRetries = 5
+)
+
+// pitSort EnginePIT 的排序字段，没有指定 Tiebreaker 时为空，使用 _shard_doc 排序
+func (opts IndexMigrateOptions) pitSort() []string {
+	if opts.Tiebreaker == "" {
+		return nil
+	}
+	return []string{opts.timestampField(), opts.Tiebreaker}
+}
+
+// resumable 游标在重新打开 point in time 后是否依然有效，只有这时才保存游标用于继续导出
+func (opts IndexMigrateOptions) resumable() bool {
+	return opts.Engine == EnginePIT && opts.Tiebreaker != ""
+}
+
+// pitSliceField 切片使用的字段，时间字段有 doc values，在不同的 point in time 中切片保持一致
+func (opts IndexMigrateOptions) pitSliceField() string {
+	if !opts.resumable() || opts.slices() < 2 {
+		return ""
+	}
+	return opts.timestampField()
+}
+
+// documentHandler 处理导出的文档，line 为归档记录，source 为文档的 _source，
+// cursor 为文档在所在切片中的排序值，仅在 EnginePIT 且指定了 Tiebreaker 时存在
+type documentHandler func(line []byte, source []byte, slice int, cursor []interface{}) error
+
+// exportDocuments 导出索引中的文档，opts.Slices > 1 时切片并发导出，
+// handler 会被多个切片并发调用，同一个切片内是串行的
+//
+// cursors 为每个切片的起始游标，仅在 EnginePIT 时有效
+func exportDocuments(ctx context.Context, opts IndexMigrateOptions, query elastic.Query, title string, cursors [][]interface{}, handler documentHandler) error {
+	slices := opts.slices()
+
+	prg := logutil.NewProgress(logutil.LoggerFunc(joblog.Printer(ctx)), title)
+
+	var lock sync.Mutex
+	var count int64
+	totals := make([]int64, slices)
+
+	latency := metrics.SearchDuration.With(opts.Index, opts.Engine)
+	observe := func(d time.Duration) {
+		latency.Observe(d.Seconds())
+	}
+
+	tasks := make([]conc.Task, 0, slices)
+	for i := 0; i < slices; i++ {
+		sliceID := i
+		var cursorExporter exporter.CursorExporter
+		h := func(buf []byte, id int64, total int64) error {
+			line, source, err := encodeRecord(buf)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			totals[sliceID] = total
+			var sum int64
+			for _, t := range totals {
+				sum += t
+			}
+			count++
+			prg.SetTotal(sum)
+			prg.SetCount(count)
+			lock.Unlock()
+			var cursor []interface{}
+			if cursorExporter != nil && opts.resumable() {
+				cursor = cursorExporter.Cursor()
+			}
+			return handler(line, source, sliceID, cursor)
+		}
+		if opts.Engine == EnginePIT {
+			var searchAfter []interface{}
+			if sliceID < len(cursors) {
+				searchAfter = cursors[sliceID]
+			}
+			cursorExporter = exporter.NewPIT(opts.ESClient, exporter.PITOptions{
+				Index:       opts.Index,
+				Query:       query,
+				KeepAlive:   "10m",
+				BatchSize:   int64(opts.BatchSize),
+				Sort:        opts.pitSort(),
+				SearchAfter: searchAfter,
+				OpenSearch:  opts.Cluster.IsOpenSearch(),
+				Retries:     exportRetries,
+				Hit:         true,
+				SliceID:     sliceID,
+				SliceMax:    slices,
+				SliceField:  opts.pitSliceField(),
+				Observe:     observe,
+			}, h)
+			tasks = append(tasks, cursorExporter)
+		} else {
+			tasks = append(tasks, exporter.New(opts.ESClient, exporter.Options{
+				Index:         opts.Index,
+				Query:         query,
+				NoMappingType: opts.Cluster.Typeless(),
+				Scroll:        "10m",
+				BatchSize:     int64(opts.BatchSize),
+				SliceID:       sliceID,
+				SliceMax:      slices,
+				Hit:           true,
+				Observe:       observe,
+			}, h))
+		}
+	}
+	return conc.Parallel(tasks...).Do(ctx)
+}
@@ -0,0 +1,508 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter 恢复时在客户端对文档的 _source 求值，语法为 Elasticsearch 查询的子集:
+//
+//	bool (must, filter, should, must_not, minimum_should_match), term, terms,
+//	prefix, regexp, range (gt, gte, lt, lte), exists, match_all
+//
+// 字段支持 a.b.c 形式的嵌套路径，字段为数组时任意一个元素满足即可，
+// regexp 与 Elasticsearch 一致，需要匹配整个字段值
+type Filter interface {
+	Match(source []byte) bool
+}
+
+// lookupField 获取字段的值，优先使用包含 '.' 的字段名，之后按嵌套路径查找
+func lookupField(doc []byte, field string) (val []byte, typ jsonparser.ValueType, ok bool) {
+	var err error
+	val, typ, _, err = jsonparser.Get(doc, field)
+	if err != nil && strings.Contains(field, ".") {
+		val, typ, _, err = jsonparser.Get(doc, strings.Split(field, ".")...)
+	}
+	return val, typ, err == nil && typ != jsonparser.Null
+}
+
+// eachValue 对字段的每个值调用 fn，字段为数组时展开
+func eachValue(doc []byte, field string, fn func(val []byte, typ jsonparser.ValueType) bool) bool {
+	val, typ, ok := lookupField(doc, field)
+	if !ok {
+		return false
+	}
+	if typ != jsonparser.Array {
+		return fn(val, typ)
+	}
+	var matched bool
+	_, _ = jsonparser.ArrayEach(val, func(v []byte, t jsonparser.ValueType, _ int, _ error) {
+		if !matched && fn(v, t) {
+			matched = true
+		}
+	})
+	return matched
+}
+
+func stringValue(val []byte, typ jsonparser.ValueType) (string, bool) {
+	if typ != jsonparser.String {
+		return "", false
+	}
+	s, err := jsonparser.ParseString(val)
+	return s, err == nil
+}
+
+type matchAllFilter struct{}
+
+func (matchAllFilter) Match(source []byte) bool {
+	return true
+}
+
+type boolFilter struct {
+	must    []Filter
+	should  []Filter
+	mustNot []Filter
+	minimum int
+}
+
+func (f *boolFilter) Match(source []byte) bool {
+	for _, c := range f.must {
+		if !c.Match(source) {
+			return false
+		}
+	}
+	for _, c := range f.mustNot {
+		if c.Match(source) {
+			return false
+		}
+	}
+	if f.minimum == 0 {
+		return true
+	}
+	var n int
+	for _, c := range f.should {
+		if c.Match(source) {
+			if n++; n >= f.minimum {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// termFilter 匹配字符串、数字或者布尔值
+type termFilter struct {
+	field  string
+	values []interface{}
+}
+
+func (f *termFilter) Match(source []byte) bool {
+	return eachValue(source, f.field, func(val []byte, typ jsonparser.ValueType) bool {
+		for _, v := range f.values {
+			if equalValue(v, val, typ) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func equalValue(expected interface{}, val []byte, typ jsonparser.ValueType) bool {
+	switch e := expected.(type) {
+	case string:
+		if s, ok := stringValue(val, typ); ok {
+			return s == e
+		}
+		// 与 Elasticsearch 一致，数字和布尔字段也可以使用字符串匹配
+		return (typ == jsonparser.Number || typ == jsonparser.Boolean) && string(val) == e
+	case float64:
+		if typ == jsonparser.Number {
+			n, err := strconv.ParseFloat(string(val), 64)
+			return err == nil && n == e
+		}
+		return false
+	case bool:
+		if typ == jsonparser.Boolean {
+			b, err := jsonparser.ParseBoolean(val)
+			return err == nil && b == e
+		}
+		return false
+	}
+	return false
+}
+
+type prefixFilter struct {
+	field  string
+	prefix string
+}
+
+func (f *prefixFilter) Match(source []byte) bool {
+	return eachValue(source, f.field, func(val []byte, typ jsonparser.ValueType) bool {
+		s, ok := stringValue(val, typ)
+		return ok && strings.HasPrefix(s, f.prefix)
+	})
+}
+
+type regexpFilter struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func (f *regexpFilter) Match(source []byte) bool {
+	return eachValue(source, f.field, func(val []byte, typ jsonparser.ValueType) bool {
+		s, ok := stringValue(val, typ)
+		return ok && f.re.MatchString(s)
+	})
+}
+
+type existsFilter struct {
+	field string
+}
+
+func (f *existsFilter) Match(source []byte) bool {
+	_, _, ok := lookupField(source, f.field)
+	return ok
+}
+
+// rangeBound 范围的边界，数字同时作为毫秒时间戳，可以解析为时间的字符串按时间比较，其他字符串按字典序比较
+type rangeBound struct {
+	op    string
+	str   string
+	num   float64
+	isNum bool
+	t     time.Time
+	isT   bool
+}
+
+func (b rangeBound) check(c int) bool {
+	switch b.op {
+	case "gt":
+		return c > 0
+	case "gte":
+		return c >= 0
+	case "lt":
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+// compare 比较字段值与边界，无法比较时返回 false
+func (b rangeBound) compare(val []byte, typ jsonparser.ValueType) (c int, ok bool) {
+	switch typ {
+	case jsonparser.Number:
+		n, err := strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			return
+		}
+		if b.isNum {
+			return compareFloat(n, b.num), true
+		}
+		// 数字字段作为毫秒时间戳与时间比较
+		if b.isT {
+			return compareTime(time.Unix(0, int64(n)*int64(time.Millisecond)), b.t), true
+		}
+	case jsonparser.String:
+		s, ok := stringValue(val, typ)
+		if !ok {
+			return 0, false
+		}
+		// 字符串字段与时间或者毫秒时间戳比较时，按时间比较
+		if b.isT {
+			if t, ok := parseTimestamp(s); ok {
+				return compareTime(t, b.t), true
+			}
+			return 0, false
+		}
+		if !b.isNum {
+			return strings.Compare(s, b.str), true
+		}
+	}
+	return
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+type rangeFilter struct {
+	field  string
+	bounds []rangeBound
+}
+
+func (f *rangeFilter) Match(source []byte) bool {
+	return eachValue(source, f.field, func(val []byte, typ jsonparser.ValueType) bool {
+		for _, b := range f.bounds {
+			c, ok := b.compare(val, typ)
+			if !ok || !b.check(c) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// ParseFilter 解析 JSON 格式的过滤条件
+func ParseFilter(buf []byte) (f Filter, err error) {
+	var q map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &q); err != nil {
+		err = fmt.Errorf("无效的过滤条件: %s", err.Error())
+		return
+	}
+	if len(q) != 1 {
+		err = fmt.Errorf("过滤条件必须只包含一个类型: %s", string(buf))
+		return
+	}
+	for typ, body := range q {
+		switch typ {
+		case "match_all":
+			f = matchAllFilter{}
+		case "bool":
+			f, err = parseBoolFilter(body)
+		case "term", "terms", "prefix", "regexp", "range":
+			f, err = parseFieldFilter(typ, body)
+		case "exists":
+			var e struct {
+				Field string `json:"field"`
+			}
+			if err = json.Unmarshal(body, &e); err != nil {
+				return
+			}
+			if e.Field == "" {
+				err = errors.New("exists 缺少 field")
+				return
+			}
+			f = &existsFilter{field: e.Field}
+		default:
+			err = errors.New("不支持的过滤条件: " + typ)
+		}
+	}
+	return
+}
+
+// parseClauses 解析 bool 中的子条件，可以是单个条件或者数组
+func parseClauses(body json.RawMessage) (out []Filter, err error) {
+	if len(body) == 0 {
+		return
+	}
+	var items []json.RawMessage
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		if err = json.Unmarshal(body, &items); err != nil {
+			return
+		}
+	} else {
+		items = []json.RawMessage{body}
+	}
+	for _, item := range items {
+		var f Filter
+		if f, err = ParseFilter(item); err != nil {
+			return
+		}
+		out = append(out, f)
+	}
+	return
+}
+
+func parseBoolFilter(body json.RawMessage) (f Filter, err error) {
+	var b struct {
+		Must               json.RawMessage `json:"must"`
+		Filter             json.RawMessage `json:"filter"`
+		Should             json.RawMessage `json:"should"`
+		MustNot            json.RawMessage `json:"must_not"`
+		MinimumShouldMatch *int            `json:"minimum_should_match"`
+	}
+	if err = json.Unmarshal(body, &b); err != nil {
+		return
+	}
+	bf := &boolFilter{}
+	var clauses []Filter
+	if bf.must, err = parseClauses(b.Must); err != nil {
+		return
+	}
+	if clauses, err = parseClauses(b.Filter); err != nil {
+		return
+	}
+	bf.must = append(bf.must, clauses...)
+	if bf.should, err = parseClauses(b.Should); err != nil {
+		return
+	}
+	if bf.mustNot, err = parseClauses(b.MustNot); err != nil {
+		return
+	}
+	// 与 Elasticsearch 一致，没有 must 和 filter 时至少满足一个 should
+	if b.MinimumShouldMatch != nil {
+		bf.minimum = *b.MinimumShouldMatch
+	} else if len(bf.must) == 0 && len(bf.should) > 0 {
+		bf.minimum = 1
+	}
+	f = bf
+	return
+}
+
+func parseFieldFilter(typ string, body json.RawMessage) (f Filter, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(body, &fields); err != nil {
+		return
+	}
+	if len(fields) != 1 {
+		err = fmt.Errorf("%s 必须只包含一个字段: %s", typ, string(body))
+		return
+	}
+	for field, val := range fields {
+		switch typ {
+		case "term":
+			// 兼容 {"field": {"value": ...}}
+			if strings.HasPrefix(strings.TrimSpace(string(val)), "{") {
+				var v struct {
+					Value json.RawMessage `json:"value"`
+				}
+				if err = json.Unmarshal(val, &v); err != nil {
+					return
+				}
+				if v.Value == nil {
+					err = errors.New("term 缺少 value: " + field)
+					return
+				}
+				val = v.Value
+			}
+			f, err = newTermFilter(field, "["+string(val)+"]")
+		case "terms":
+			f, err = newTermFilter(field, string(val))
+		case "prefix":
+			var s string
+			if err = json.Unmarshal(val, &s); err != nil {
+				return
+			}
+			f = &prefixFilter{field: field, prefix: s}
+		case "regexp":
+			var s string
+			if err = json.Unmarshal(val, &s); err != nil {
+				return
+			}
+			var re *regexp.Regexp
+			if re, err = regexp.Compile("^(?:" + s + ")$"); err != nil {
+				return
+			}
+			f = &regexpFilter{field: field, re: re}
+		case "range":
+			f, err = parseRangeFilter(field, val)
+		}
+	}
+	return
+}
+
+// newTermFilter values 为 JSON 数组，只能包含字符串、数字或者布尔值
+func newTermFilter(field string, values string) (f Filter, err error) {
+	tf := &termFilter{field: field}
+	if err = json.Unmarshal([]byte(values), &tf.values); err != nil {
+		return
+	}
+	for _, v := range tf.values {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			err = fmt.Errorf("无效的 term 值: %s: %v", field, v)
+			return
+		}
+	}
+	f = tf
+	return
+}
+
+func parseRangeFilter(field string, body json.RawMessage) (f Filter, err error) {
+	var ops map[string]interface{}
+	if err = json.Unmarshal(body, &ops); err != nil {
+		return
+	}
+	rf := &rangeFilter{field: field}
+	for _, op := range []string{"gt", "gte", "lt", "lte"} {
+		v, ok := ops[op]
+		if !ok || v == nil {
+			continue
+		}
+		b := rangeBound{op: op}
+		switch v := v.(type) {
+		case float64:
+			b.num, b.isNum = v, true
+			b.t, b.isT = time.Unix(0, int64(v)*int64(time.Millisecond)).UTC(), true
+		case string:
+			b.str = v
+			b.t, b.isT = parseTimestamp(v)
+		default:
+			err = fmt.Errorf("无效的 range 边界: %s.%s", field, op)
+			return
+		}
+		rf.bounds = append(rf.bounds, b)
+		delete(ops, op)
+	}
+	for op := range ops {
+		err = fmt.Errorf("不支持的 range 参数: %s.%s", field, op)
+		return
+	}
+	if len(rf.bounds) == 0 {
+		err = errors.New("range 缺少边界: " + field)
+		return
+	}
+	f = rf
+	return
+}
+
+// NewTimeRangeFilter 按时间字段过滤，from 包含，to 不包含，为空时不限制
+func NewTimeRangeFilter(field string, from string, to string) (f Filter, err error) {
+	rf := &rangeFilter{field: field}
+	for _, item := range []struct{ op, val string }{{"gte", from}, {"lt", to}} {
+		if item.val == "" {
+			continue
+		}
+		b := rangeBound{op: item.op, str: item.val}
+		if b.t, b.isT = parseTimestamp(item.val); !b.isT {
+			err = errors.New("无效的时间: " + item.val)
+			return
+		}
+		rf.bounds = append(rf.bounds, b)
+	}
+	if len(rf.bounds) == 0 {
+		return
+	}
+	f = rf
+	return
+}
+
+// AndFilter 组合多个过滤条件，忽略为空的条件，全部为空时返回 nil
+func AndFilter(filters ...Filter) Filter {
+	bf := &boolFilter{}
+	for _, f := range filters {
+		if f != nil {
+			bf.must = append(bf.must, f)
+		}
+	}
+	switch len(bf.must) {
+	case 0:
+		return nil
+	case 1:
+		return bf.must[0]
+	}
+	return bf
+}
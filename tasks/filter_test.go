@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	docs := []string{
+		`{"@timestamp":"2020-01-02T03:00:00Z","host":{"name":"web-1"},"status":200,"path":"/api/users","tags":["a","b"]}`,
+		`{"@timestamp":"2020-01-02T05:00:00Z","host.name":"web-2","status":500,"path":"/static/app.js","ok":false}`,
+		`{"@timestamp":1577939400000,"host":{"name":"db-1"},"status":404,"path":"/api/orders"}`,
+	}
+	cases := []struct {
+		filter string
+		match  []bool
+	}{
+		{`{"match_all":{}}`, []bool{true, true, true}},
+		{`{"term":{"host.name":"web-2"}}`, []bool{false, true, false}},
+		{`{"term":{"status":{"value":404}}}`, []bool{false, false, true}},
+		{`{"term":{"status":"200"}}`, []bool{true, false, false}},
+		{`{"term":{"ok":false}}`, []bool{false, true, false}},
+		{`{"terms":{"tags":["b","c"]}}`, []bool{true, false, false}},
+		{`{"prefix":{"host.name":"web-"}}`, []bool{true, true, false}},
+		{`{"regexp":{"path":"/api/.*"}}`, []bool{true, false, true}},
+		{`{"regexp":{"path":"api"}}`, []bool{false, false, false}},
+		{`{"exists":{"field":"ok"}}`, []bool{false, true, false}},
+		{`{"range":{"status":{"gte":400,"lt":500}}}`, []bool{false, false, true}},
+		{`{"range":{"@timestamp":{"gte":"2020-01-02T04:00:00Z"}}}`, []bool{false, true, true}},
+		{`{"range":{"@timestamp":{"lt":1577937600000}}}`, []bool{true, false, false}},
+		{`{"range":{"path":{"gte":"/api","lt":"/b"}}}`, []bool{true, false, true}},
+		{`{"bool":{"must":{"prefix":{"path":"/api"}},"must_not":[{"term":{"status":404}}]}}`, []bool{true, false, false}},
+		{`{"bool":{"should":[{"term":{"status":200}},{"term":{"status":500}}]}}`, []bool{true, true, false}},
+		{`{"bool":{"filter":[{"prefix":{"path":"/"}}],"should":[{"term":{"status":200}}]}}`, []bool{true, true, true}},
+		{`{"bool":{"should":[{"term":{"status":200}},{"prefix":{"path":"/api"}}],"minimum_should_match":2}}`, []bool{true, false, false}},
+	}
+	for _, c := range cases {
+		f, err := ParseFilter([]byte(c.filter))
+		assert.NoError(t, err, c.filter)
+		for i, doc := range docs {
+			assert.Equal(t, c.match[i], f.Match([]byte(doc)), "%s: %d", c.filter, i)
+		}
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`{"match":{"a":"b"}}`,
+		`{"term":{"a":"b","c":"d"}}`,
+		`{"term":{"a":{"x":1}}}`,
+		`{"regexp":{"a":"("}}`,
+		`{"range":{"a":{"from":1}}}`,
+		`{"bool":{"must":[{"nope":{}}]}}`,
+	} {
+		_, err := ParseFilter([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+
+	f, err := NewTimeRangeFilter("@timestamp", "2020-01-02T04:00:00Z", "2020-01-02T05:00:00Z")
+	assert.NoError(t, err)
+	f = AndFilter(nil, f)
+	assert.Equal(t, []bool{false, false, true}, []bool{f.Match([]byte(docs[0])), f.Match([]byte(docs[1])), f.Match([]byte(docs[2]))})
+	f, err = NewTimeRangeFilter("@timestamp", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, AndFilter(f))
+	_, err = NewTimeRangeFilter("@timestamp", "yesterday", "")
+	assert.Error(t, err)
+}
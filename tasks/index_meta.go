@@ -0,0 +1,223 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/olivere/elastic"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FileIndexMeta = "_index.json"
+)
+
+// IndexMeta 索引的设置、映射和别名，保存在 INDEX/_index.json
+type IndexMeta struct {
+	Index   string          `json:"index"`
+	Cluster ManifestCluster `json:"cluster"`
+	// Typeless 映射中是否不包含类型名，6.x 的映射以类型名为键
+	Typeless  bool                       `json:"typeless"`
+	Settings  map[string]interface{}     `json:"settings"`
+	Mappings  json.RawMessage            `json:"mappings"`
+	Aliases   map[string]json.RawMessage `json:"aliases"`
+	CreatedAt time.Time                  `json:"created_at"`
+}
+
+// 不需要或者无法在新索引上恢复的设置
+var ignoredSettingPrefixes = []string{
+	"index.uuid",
+	"index.creation_date",
+	"index.version.",
+	"index.provided_name",
+	"index.blocks.",
+	"index.routing.",
+	"index.resize.",
+	"index.shrink.",
+	"index.verified_before_close",
+	"index.frozen",
+	"index.search.throttled",
+	"index.lifecycle.",
+	"index.history.uuid",
+	"index.store.snapshot.",
+	"index.plugins.index_state_management.",
+	"index.opendistro.index_state_management.",
+}
+
+func filterSettings(settings map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range settings {
+		ignored := false
+		for _, prefix := range ignoredSettingPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (opts IndexMigrateOptions) FilenameIndexMetaRemote() string {
+	return opts.Index + "/" + FileIndexMeta
+}
+
+// indexCaptureMeta 读取索引的设置、映射和别名并保存到存储
+func indexCaptureMeta(ctx context.Context, opts IndexMigrateOptions) (err error) {
+	var res *elastic.Response
+	if res, err = opts.ESClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/" + opts.Index,
+		Params: map[string][]string{"flat_settings": {"true"}},
+	}); err != nil {
+		return
+	}
+	var body map[string]struct {
+		Aliases  map[string]json.RawMessage `json:"aliases"`
+		Mappings json.RawMessage            `json:"mappings"`
+		Settings map[string]interface{}     `json:"settings"`
+	}
+	if err = json.Unmarshal(res.Body, &body); err != nil {
+		return
+	}
+	item, ok := body[opts.Index]
+	if !ok {
+		err = errors.New("无法获取索引信息: " + opts.Index)
+		return
+	}
+	meta := IndexMeta{
+		Index: opts.Index,
+		Cluster: ManifestCluster{
+			Name:         opts.Cluster.ClusterName,
+			UUID:         opts.Cluster.ClusterUUID,
+			Distribution: opts.Cluster.Distribution,
+			Version:      opts.Cluster.Version,
+		},
+		Typeless:  opts.Cluster.Typeless(),
+		Settings:  filterSettings(item.Settings),
+		Mappings:  item.Mappings,
+		Aliases:   item.Aliases,
+		CreatedAt: time.Now(),
+	}
+	var buf []byte
+	if buf, err = json.MarshalIndent(meta, "", "  "); err != nil {
+		return
+	}
+	return opts.Storage.PutStream(ctx, opts.FilenameIndexMetaRemote(), bytes.NewReader(buf), storage.PutOptions{})
+}
+
+// LoadIndexMeta 读取索引的设置、映射和别名，不存在时返回 nil
+func LoadIndexMeta(ctx context.Context, store storage.Storage, index string) (m *IndexMeta, err error) {
+	var rc io.ReadCloser
+	if rc, err = store.Get(ctx, index+"/"+FileIndexMeta, 0, 0); err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	defer rc.Close()
+	var buf []byte
+	if buf, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+	m = &IndexMeta{}
+	err = json.Unmarshal(buf, m)
+	return
+}
+
+// IndexMetaOverrides 恢复时覆盖的设置，Shards 和 Replicas 小于 0 时使用归档中的值
+type IndexMetaOverrides struct {
+	Shards     int
+	Replicas   int
+	Allocation map[string]string
+}
+
+// typelessMappings 将映射转换为不包含类型名的格式，typ 为 6.x 映射中原有的类型名
+func (m *IndexMeta) typelessMappings() (out map[string]interface{}, typ string, err error) {
+	if len(m.Mappings) == 0 || string(m.Mappings) == "null" {
+		return
+	}
+	var raw map[string]interface{}
+	if err = json.Unmarshal(m.Mappings, &raw); err != nil {
+		return
+	}
+	if m.Typeless {
+		out = raw
+		return
+	}
+	if len(raw) > 1 {
+		var types []string
+		for k := range raw {
+			types = append(types, k)
+		}
+		sort.Strings(types)
+		err = errors.New("映射中包含多个类型，无法恢复: " + strings.Join(types, ", "))
+		return
+	}
+	for k, v := range raw {
+		typ = k
+		out, _ = v.(map[string]interface{})
+	}
+	return
+}
+
+// CreateBody 生成在目标集群上创建索引的请求
+func (m *IndexMeta) CreateBody(info cluster.Info, o IndexMetaOverrides) (body map[string]interface{}, err error) {
+	settings := map[string]interface{}{}
+	for k, v := range m.Settings {
+		settings[k] = v
+	}
+	if o.Shards >= 0 {
+		settings["index.number_of_shards"] = o.Shards
+	}
+	if o.Replicas >= 0 {
+		settings["index.number_of_replicas"] = o.Replicas
+	}
+	for k, v := range o.Allocation {
+		settings["index.routing.allocation."+k] = v
+	}
+	body = map[string]interface{}{"settings": settings}
+
+	var mappings map[string]interface{}
+	var original string
+	if mappings, original, err = m.typelessMappings(); err != nil {
+		return
+	}
+	if mappings != nil {
+		// 保留归档中的类型名，与恢复时文档的 _type 一致
+		if typ := info.MappingType(); typ != "" {
+			if original != "" {
+				typ = original
+			}
+			body["mappings"] = map[string]interface{}{typ: mappings}
+		} else {
+			body["mappings"] = mappings
+		}
+	}
+
+	if len(m.Aliases) > 0 {
+		aliases := map[string]interface{}{}
+		for name, raw := range m.Aliases {
+			var alias map[string]interface{}
+			if err = json.Unmarshal(raw, &alias); err != nil {
+				return
+			}
+			// 恢复的索引不应该成为写入索引
+			delete(alias, "is_write_index")
+			aliases[name] = alias
+		}
+		body["aliases"] = aliases
+	}
+	return
+}
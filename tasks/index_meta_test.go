@@ -0,0 +1,60 @@
+package tasks
+
+import (
+	"encoding/json"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilterSettings(t *testing.T) {
+	out := filterSettings(map[string]interface{}{
+		"index.uuid":                                "x",
+		"index.creation_date":                       "1",
+		"index.version.created":                     "6080099",
+		"index.blocks.write":                        "true",
+		"index.routing.allocation.require.disktype": "ssd",
+		"index.number_of_shards":                    "3",
+		"index.analysis.analyzer.a.type":            "standard",
+	})
+	assert.Equal(t, map[string]interface{}{
+		"index.number_of_shards":         "3",
+		"index.analysis.analyzer.a.type": "standard",
+	}, out)
+}
+
+func TestIndexMetaCreateBody(t *testing.T) {
+	m := &IndexMeta{
+		Settings: map[string]interface{}{"index.number_of_shards": "3"},
+		Mappings: json.RawMessage(`{"doc":{"properties":{"a":{"type":"keyword"}}}}`),
+		Aliases:  map[string]json.RawMessage{"logs": json.RawMessage(`{"is_write_index":true}`)},
+	}
+	es7 := cluster.Info{Distribution: cluster.DistributionElasticsearch, Major: 7}
+	body, err := m.CreateBody(es7, IndexMetaOverrides{Shards: -1, Replicas: 0, Allocation: map[string]string{"require.disktype": "hdd"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"index.number_of_shards":                    "3",
+		"index.number_of_replicas":                  0,
+		"index.routing.allocation.require.disktype": "hdd",
+	}, body["settings"])
+	assert.Equal(t, map[string]interface{}{"properties": map[string]interface{}{"a": map[string]interface{}{"type": "keyword"}}}, body["mappings"])
+	assert.Equal(t, map[string]interface{}{"logs": map[string]interface{}{}}, body["aliases"])
+
+	m.Typeless = true
+	m.Mappings = json.RawMessage(`{"properties":{"a":{"type":"keyword"}}}`)
+	es6 := cluster.Info{Distribution: cluster.DistributionElasticsearch, Major: 6}
+	body, err = m.CreateBody(es6, IndexMetaOverrides{Shards: 6, Replicas: -1})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, body["settings"].(map[string]interface{})["index.number_of_shards"])
+	assert.Contains(t, body["mappings"], "_doc")
+
+	m.Typeless = false
+	m.Mappings = json.RawMessage(`{"doc":{"properties":{"a":{"type":"keyword"}}}}`)
+	body, err = m.CreateBody(es6, IndexMetaOverrides{Shards: -1, Replicas: -1})
+	assert.NoError(t, err)
+	assert.Contains(t, body["mappings"], "doc")
+
+	m.Mappings = json.RawMessage(`{"a":{},"b":{}}`)
+	_, err = m.CreateBody(es7, IndexMetaOverrides{Shards: -1, Replicas: -1})
+	assert.Error(t, err)
+}
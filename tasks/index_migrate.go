@@ -2,138 +2,140 @@ package tasks
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/buger/jsonparser"
 	"github.com/guoyk93/conc"
-	"github.com/guoyk93/esexporter"
-	"github.com/guoyk93/logutil"
+	"github.com/guoyk93/esbridge/cluster"
+	"github.com/guoyk93/esbridge/exporter"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/storage"
 	"github.com/klauspost/pgzip"
 	"github.com/olivere/elastic"
-	"github.com/tencentyun/cos-go-sdk-v5"
-	"log"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
 const (
 	keyProject = "project"
+	keyMissing = "missing"
 )
 
 type IndexMigrateOptions struct {
 	ESClient         *elastic.Client
-	COSClient        *cos.Client
+	Storage          storage.Storage
 	NoDelete         bool
 	Dir              string
 	Index            string
 	BatchSize        int
 	Concurrency      int
 	CompressionLevel int
+	// Stream 导出时直接分块上传到存储，不写入本地工作目录
+	Stream      bool
+	PartSize    int64
+	PartRetries int
+	// Slices 单个导出使用的切片数
+	Slices int
+	// Engine 导出方式，EngineScroll 或 EnginePIT
+	Engine string
+	// Tiebreaker EnginePIT 排序时在时间字段之后使用的字段，需要有 doc values 且每个文档唯一，
+	// 指定后才能在中断后从游标继续导出
+	Tiebreaker string
+	Cluster    cluster.Info
+	// Resume 从之前保存的进度继续迁移
+	Resume bool
+	// TimestampField 描述文件中统计时间范围使用的字段
+	TimestampField string
+	// Version 写入描述文件的 esbridge 版本
+	Version string
+	// StorageClass 归档文件的存储类型，留空时使用存储后端的默认值
+	StorageClass string
+
+	checkpoint *checkpointStore
 }
 
 func (opts IndexMigrateOptions) Workspace() string {
 	return filepath.Join(opts.Dir, opts.Index)
 }
 
+func (opts IndexMigrateOptions) slices() int {
+	if opts.Slices < 1 {
+		return 1
+	}
+	return opts.Slices
+}
+
 func IndexMigrateNeo(opts IndexMigrateOptions) conc.Task {
 	return conc.TaskFunc(func(ctx context.Context) (err error) {
-		log.Printf("确保工作目录: %s", opts.Workspace())
-		if err = os.RemoveAll(opts.Workspace()); err != nil {
-			return
+		joblog.Printf(ctx, "确保工作目录: %s", opts.Workspace())
+		if !opts.Resume {
+			if err = os.RemoveAll(opts.Workspace()); err != nil {
+				return
+			}
 		}
 		if err = os.MkdirAll(opts.Workspace(), 0755); err != nil {
 			return
 		}
-		log.Printf("取消索引只读状态，防止打开失败: %s", opts.Index)
+		if opts.checkpoint, err = newCheckpointStore(ctx, opts); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "取消索引只读状态，防止打开失败: %s", opts.Index)
 		if _, err = opts.ESClient.IndexPutSettings(opts.Index).FlatSettings(true).BodyJson(map[string]interface{}{
 			"index.blocks.write":                  nil,
 			"index.blocks.read_only_allow_delete": nil,
 		}).Do(context.Background()); err != nil {
 			return
 		}
-		log.Printf("打开索引并等待索引恢复: %s", opts.Index)
+		joblog.Printf(ctx, "打开索引并等待索引恢复: %s", opts.Index)
 		if _, err = opts.ESClient.OpenIndex(opts.Index).WaitForActiveShards("all").Do(ctx); err != nil {
 			return
 		}
-		log.Printf("获取索引中包含的项目: %s", opts.Index)
+		joblog.Printf(ctx, "保存索引设置和映射: %s", opts.FilenameIndexMetaRemote())
+		if err = indexCaptureMeta(ctx, opts); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "获取索引中包含的项目: %s", opts.Index)
 		var projects []string
 		if err = IndexCollectProjects(opts, &projects).Do(ctx); err != nil {
 			return
 		}
-		log.Printf("准备写入文件")
-		var files = make(map[string]*os.File)
-		for _, p := range projects {
-			if files[p], err = os.OpenFile(filepath.Join(opts.Workspace(), p+ExtCompressedNDJSON), os.O_CREATE|os.O_RDWR, 0644); err != nil {
-				return
-			}
-		}
-		log.Printf("准备压缩写入")
-		var zips = make(map[string]*pgzip.Writer)
-		for p, f := range files {
-			if zips[p], err = pgzip.NewWriterLevel(f, opts.CompressionLevel); err != nil {
-				return
-			}
+		if opts.Stream {
+			err = indexStreamProjects(ctx, opts, projects)
+		} else {
+			err = indexExportProjects(ctx, opts, projects)
 		}
-		prg := logutil.NewProgress(logutil.LoggerFunc(log.Printf), "导出进度")
-		if err = esexporter.New(opts.ESClient, esexporter.Options{
-			Index:     opts.Index,
-			Type:      "_doc",
-			Scroll:    "10m",
-			BatchSize: int64(opts.BatchSize),
-		}, func(buf []byte, id int64, total int64) (err error) {
-			prg.SetTotal(total)
-			prg.SetCount(id + 1)
-			var p string
-			if p, err = jsonparser.GetString(buf, "project"); err != nil {
-				return
-			}
-			if p == "" {
-				err = errors.New("missing 'project'")
-				return
-			}
-			w := zips[p]
-			if w == nil {
-				err = errors.New("missing zip writer")
-				return
-			}
-			if _, err = w.Write(buf); err != nil {
-				return
-			}
-			if _, err = w.Write(newLine); err != nil {
-				return
-			}
+		if err != nil {
 			return
-		}).Do(ctx); err != nil {
-			return
-		}
-		log.Printf("导出完成")
-		for _, zw := range zips {
-			if err = zw.Close(); err != nil {
-				return
-			}
 		}
-		for _, f := range files {
-			if err = f.Close(); err != nil {
-				return
-			}
+		joblog.Printf(ctx, "写入描述文件: %s", opts.FilenameManifestRemote())
+		var m *Manifest
+		if m, err = writeManifest(ctx, opts, projects); err != nil {
+			return
 		}
-		log.Printf("准备上传")
-		for _, p := range projects {
-			if err = ProjectUploadCompressedData(ProjectMigrateOptions{
-				Project:             p,
-				IndexMigrateOptions: opts,
-			}).Do(ctx); err != nil {
+		joblog.Printf(ctx, "校验归档文档数: %s", opts.Index)
+		if err = indexVerifyCounts(ctx, opts, m); err != nil {
+			if !opts.NoDelete {
 				return
 			}
+			joblog.Printf(ctx, "校验失败: %s", err.Error())
+			err = nil
 		}
 		if !opts.NoDelete {
-			log.Printf("删除索引: %s", opts.Index)
+			joblog.Printf(ctx, "删除索引: %s", opts.Index)
 			if _, err = opts.ESClient.DeleteIndex(opts.Index).Do(ctx); err != nil {
 				return
 			}
 		}
-		log.Printf("删除本地目录: %s", opts.Workspace())
+		joblog.Printf(ctx, "删除迁移进度: %s", opts.Index)
+		if err = opts.checkpoint.Clear(ctx); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "删除本地目录: %s", opts.Workspace())
 		if err = os.RemoveAll(opts.Workspace()); err != nil {
 			return
 		}
@@ -143,27 +145,34 @@ func IndexMigrateNeo(opts IndexMigrateOptions) conc.Task {
 
 func IndexMigrate(opts IndexMigrateOptions) conc.Task {
 	return conc.TaskFunc(func(ctx context.Context) (err error) {
-		log.Printf("确保工作目录: %s", opts.Workspace())
+		joblog.Printf(ctx, "确保工作目录: %s", opts.Workspace())
 		if err = os.MkdirAll(opts.Workspace(), 0755); err != nil {
 			return
 		}
-		log.Printf("取消索引只读状态，防止打开失败: %s", opts.Index)
+		if opts.checkpoint, err = newCheckpointStore(ctx, opts); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "取消索引只读状态，防止打开失败: %s", opts.Index)
 		if _, err = opts.ESClient.IndexPutSettings(opts.Index).FlatSettings(true).BodyJson(map[string]interface{}{
 			"index.blocks.write":                  nil,
 			"index.blocks.read_only_allow_delete": nil,
 		}).Do(context.Background()); err != nil {
 			return
 		}
-		log.Printf("打开索引并等待索引恢复: %s", opts.Index)
+		joblog.Printf(ctx, "打开索引并等待索引恢复: %s", opts.Index)
 		if _, err = opts.ESClient.OpenIndex(opts.Index).WaitForActiveShards("all").Do(ctx); err != nil {
 			return
 		}
-		log.Printf("获取索引中包含的项目: %s", opts.Index)
+		joblog.Printf(ctx, "保存索引设置和映射: %s", opts.FilenameIndexMetaRemote())
+		if err = indexCaptureMeta(ctx, opts); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "获取索引中包含的项目: %s", opts.Index)
 		var projects []string
 		if err = IndexCollectProjects(opts, &projects).Do(ctx); err != nil {
 			return
 		}
-		log.Printf("索引包含以下项目: %s", strings.Join(projects, ", "))
+		joblog.Printf(ctx, "索引包含以下项目: %s", strings.Join(projects, ", "))
 		done, total := int64(0), int64(len(projects))
 		tasks := make([]conc.Task, 0, len(projects))
 		for _, _project := range projects {
@@ -174,20 +183,37 @@ func IndexMigrate(opts IndexMigrateOptions) conc.Task {
 					Project:             project,
 				}
 				atomic.AddInt64(&done, 1)
-				log.Printf("项目进度: %d/%d", done, total)
+				joblog.Printf(ctx, "项目进度: %d/%d", done, total)
 				return ProjectMigrate(pOpts).Do(ctx)
 			}))
 		}
 		if err = conc.ParallelWithLimit(opts.Concurrency, tasks...).Do(ctx); err != nil {
 			return
 		}
+		joblog.Printf(ctx, "写入描述文件: %s", opts.FilenameManifestRemote())
+		var m *Manifest
+		if m, err = writeManifest(ctx, opts, projects); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "校验归档文档数: %s", opts.Index)
+		if err = indexVerifyCounts(ctx, opts, m); err != nil {
+			if !opts.NoDelete {
+				return
+			}
+			joblog.Printf(ctx, "校验失败: %s", err.Error())
+			err = nil
+		}
 		if !opts.NoDelete {
-			log.Printf("删除索引: %s", opts.Index)
+			joblog.Printf(ctx, "删除索引: %s", opts.Index)
 			if _, err = opts.ESClient.DeleteIndex(opts.Index).Do(ctx); err != nil {
 				return
 			}
 		}
-		log.Printf("删除本地目录: %s", opts.Workspace())
+		joblog.Printf(ctx, "删除迁移进度: %s", opts.Index)
+		if err = opts.checkpoint.Clear(ctx); err != nil {
+			return
+		}
+		joblog.Printf(ctx, "删除本地目录: %s", opts.Workspace())
 		if err = os.RemoveAll(opts.Workspace()); err != nil {
 			return
 		}
@@ -197,32 +223,287 @@ func IndexMigrate(opts IndexMigrateOptions) conc.Task {
 
 func IndexCollectProjects(opts IndexMigrateOptions, out *[]string) conc.Task {
 	return conc.TaskFunc(func(ctx context.Context) (err error) {
-		var res *elastic.SearchResult
-		if res, err = opts.ESClient.Search(opts.Index).Aggregation(
-			keyProject,
-			elastic.NewTermsAggregation().Field(keyProject).Size(99999),
-		).Size(0).Do(ctx); err != nil {
+		var counts []projectCount
+		if counts, _, err = indexCountProjects(ctx, opts); err != nil {
 			return
 		}
-		termAgg, ok := res.Aggregations.Terms(keyProject)
+		projects := make([]string, 0, len(counts))
+		for _, c := range counts {
+			projects = append(projects, c.Project)
+		}
+		*out = projects
+		return
+	})
+}
+
+type projectCount struct {
+	Project   string
+	Documents int64
+}
+
+// indexCountProjects 统计索引中每个项目的文档数，以及缺少项目字段的文档数
+func indexCountProjects(ctx context.Context, opts IndexMigrateOptions) (counts []projectCount, missing int64, err error) {
+	// 使用原始请求，olivere/elastic v6 无法解析 7.x 之后的 hits.total
+	var res *elastic.Response
+	if res, err = opts.ESClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/" + opts.Index + "/_search",
+		Body: map[string]interface{}{
+			"size": 0,
+			"aggs": map[string]interface{}{
+				keyProject: map[string]interface{}{
+					"terms": map[string]interface{}{
+						"field": keyProject,
+						"size":  99999,
+					},
+				},
+				keyMissing: map[string]interface{}{
+					"missing": map[string]interface{}{
+						"field": keyProject,
+					},
+				},
+			},
+		},
+	}); err != nil {
+		return
+	}
+	var body struct {
+		Aggregations struct {
+			Project *struct {
+				SumOtherDocCount int64 `json:"sum_other_doc_count"`
+				Buckets          []struct {
+					Key      interface{} `json:"key"`
+					DocCount int64       `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"project"`
+			Missing struct {
+				DocCount int64 `json:"doc_count"`
+			} `json:"missing"`
+		} `json:"aggregations"`
+	}
+	if err = json.Unmarshal(res.Body, &body); err != nil {
+		return
+	}
+	termAgg := body.Aggregations.Project
+	if termAgg == nil {
+		err = errors.New("无法找到聚合结果")
+		return
+	}
+	if termAgg.SumOtherDocCount > 0 {
+		err = errors.New("聚合结果无法包含所有可能的项目")
+		return
+	}
+	counts = make([]projectCount, 0, len(termAgg.Buckets))
+	for _, bucket := range termAgg.Buckets {
+		key, ok := bucket.Key.(string)
 		if !ok {
-			err = errors.New("无法找到聚合结果")
+			err = errors.New("聚合结果出现非字符串值")
 			return
 		}
-		if termAgg.SumOfOtherDocCount > 0 {
-			err = errors.New("聚合结果无法包含所有可能的项目")
+		counts = append(counts, projectCount{Project: key, Documents: bucket.DocCount})
+	}
+	missing = body.Aggregations.Missing.DocCount
+	return
+}
+
+func indexExportProjects(ctx context.Context, opts IndexMigrateOptions, projects []string) (err error) {
+	store := opts.checkpoint
+	var exported bool
+	store.Update(func(cp *Checkpoint) {
+		exported = cp.Exported
+	})
+	if exported {
+		for _, p := range projects {
+			if store.Project(p).Done {
+				continue
+			}
+			if _, err = os.Stat(filepath.Join(opts.Workspace(), p+ExtCompressedNDJSON)); err != nil {
+				joblog.Printf(ctx, "本地文件缺失，重新导出: %s", err.Error())
+				exported, err = false, nil
+				break
+			}
+		}
+	}
+	if !exported {
+		joblog.Printf(ctx, "准备写入文件")
+		var files = make(map[string]*os.File)
+		for _, p := range projects {
+			if store.Project(p).Done {
+				joblog.Printf(ctx, "索引/项目已经完成: %s/%s", opts.Index, p)
+				continue
+			}
+			if files[p], err = os.OpenFile(filepath.Join(opts.Workspace(), p+ExtCompressedNDJSON), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); err != nil {
+				return
+			}
+		}
+		joblog.Printf(ctx, "准备压缩写入")
+		var zips = make(map[string]*pgzip.Writer)
+		var stats = make(map[string]*statsRecorder)
+		// 切片并发导出，只在写入同一个项目时互斥
+		var locks = make(map[string]*sync.Mutex)
+		for p, f := range files {
+			locks[p] = &sync.Mutex{}
+			stats[p] = newStatsRecorder(opts.Index+"/"+p+ExtCompressedNDJSON, opts.timestampField())
+			if zips[p], err = pgzip.NewWriterLevel(io.MultiWriter(f, stats[p]), opts.CompressionLevel); err != nil {
+				return
+			}
+		}
+		if err = exportDocuments(ctx, opts, nil, "导出进度", nil, func(line []byte, source []byte, slice int, cursor []interface{}) (err error) {
+			var p string
+			if p, err = jsonparser.GetString(source, keyProject); err != nil {
+				return
+			}
+			if p == "" {
+				err = errors.New("missing 'project'")
+				return
+			}
+			if store.Project(p).Done {
+				return
+			}
+			w := zips[p]
+			if w == nil {
+				err = errors.New("missing zip writer")
+				return
+			}
+			locks[p].Lock()
+			defer locks[p].Unlock()
+			if _, err = w.Write(line); err != nil {
+				return
+			}
+			if _, err = w.Write(newLine); err != nil {
+				return
+			}
+			stats[p].AddDocument(line, source)
+			return
+		}); err != nil {
 			return
 		}
-		projects := make([]string, 0, len(termAgg.Buckets))
-		for _, bucket := range termAgg.Buckets {
-			key, ok := bucket.Key.(string)
-			if !ok {
-				err = errors.New("聚合结果出现非字符串值")
+		joblog.Printf(ctx, "导出完成")
+		for _, zw := range zips {
+			if err = zw.Close(); err != nil {
 				return
 			}
-			projects = append(projects, key)
 		}
-		*out = projects
+		for _, f := range files {
+			if err = f.Close(); err != nil {
+				return
+			}
+		}
+		for p, r := range stats {
+			store.UpdateProject(p, func(p *ProjectCheckpoint) {
+				p.Stats = r.Manifest()
+			})
+		}
+		store.Update(func(cp *Checkpoint) {
+			cp.Exported = true
+		})
+		if err = store.Save(ctx); err != nil {
+			return
+		}
+	}
+	joblog.Printf(ctx, "准备上传")
+	for _, p := range projects {
+		if store.Project(p).Done {
+			continue
+		}
+		if err = ProjectUploadCompressedData(ProjectMigrateOptions{
+			Project:             p,
+			IndexMigrateOptions: opts,
+		}).Do(ctx); err != nil {
+			return
+		}
+		store.UpdateProject(p, func(p *ProjectCheckpoint) {
+			p.Done = true
+		})
+		if err = store.Save(ctx); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func indexStreamProjects(ctx context.Context, opts IndexMigrateOptions, projects []string) (err error) {
+	joblog.Printf(ctx, "准备流式上传")
+	var writers = make(map[string]*archiveWriter)
+	defer func() {
+		if err != nil {
+			for _, w := range writers {
+				w.Abort()
+			}
+		}
+	}()
+	for _, p := range projects {
+		if opts.checkpoint.Project(p).Done {
+			joblog.Printf(ctx, "索引/项目已经完成: %s/%s", opts.Index, p)
+			continue
+		}
+		if writers[p], err = newArchiveWriter(ctx, ProjectMigrateOptions{
+			Project:             p,
+			IndexMigrateOptions: opts,
+		}, opts.checkpoint); err != nil {
+			return
+		}
+	}
+
+	if len(writers) == 0 {
 		return
-	})
+	}
+
+	// 每个切片从所有项目中最小的游标开始，之后跳过各项目已经上传过的文档
+	cursors := make([][]interface{}, opts.slices())
+	for i := range cursors {
+		first := true
+		for _, w := range writers {
+			var c []interface{}
+			if i < len(w.Cursors()) {
+				c = w.Cursors()[i]
+			}
+			if first || exporter.CompareCursor(c, cursors[i]) < 0 {
+				cursors[i] = c
+			}
+			first = false
+		}
+	}
+	skipped := make(map[string][][]interface{})
+	for p, w := range writers {
+		skipped[p] = w.Cursors()
+	}
+
+	if err = exportDocuments(ctx, opts, nil, "导出进度", cursors, func(line []byte, source []byte, slice int, cursor []interface{}) (err error) {
+		var p string
+		if p, err = jsonparser.GetString(source, keyProject); err != nil {
+			return
+		}
+		if p == "" {
+			err = errors.New("missing 'project'")
+			return
+		}
+		if opts.checkpoint.Project(p).Done {
+			return
+		}
+		w := writers[p]
+		if w == nil {
+			err = errors.New("missing archive writer")
+			return
+		}
+		if cs := skipped[p]; cursor != nil && slice < len(cs) && cs[slice] != nil {
+			if exporter.CompareCursor(cursor, cs[slice]) <= 0 {
+				return
+			}
+		}
+		return w.Write(ctx, line, source, slice, cursor)
+	}); err != nil {
+		return
+	}
+	joblog.Printf(ctx, "导出完成，完成上传")
+	for _, p := range projects {
+		if writers[p] == nil {
+			continue
+		}
+		if err = writers[p].Close(ctx); err != nil {
+			return
+		}
+		delete(writers, p)
+	}
+	return
 }
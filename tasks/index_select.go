@@ -0,0 +1,152 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/storage"
+	"github.com/olivere/elastic"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DateSourceName         = "name"
+	DateSourceCreationDate = "creation_date"
+)
+
+type IndexSelectOptions struct {
+	ESClient *elastic.Client
+	Storage  storage.Storage
+	// Pattern 索引名匹配规则，例如 logs-*
+	Pattern string
+	// OlderThan 只选择早于此时长的索引
+	OlderThan time.Duration
+	// DateLayout 索引名中日期的格式，为空时自动识别，无法识别时使用 creation_date
+	DateLayout string
+	Now        time.Time
+}
+
+type IndexCandidate struct {
+	Index      string
+	Date       time.Time
+	DateSource string
+}
+
+var indexDatePatterns = []struct {
+	re     *regexp.Regexp
+	layout string
+}{
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}`), "2006-01-02"},
+	{regexp.MustCompile(`\d{4}\.\d{2}\.\d{2}`), "2006.01.02"},
+	{regexp.MustCompile(`\d{4}_\d{2}_\d{2}`), "2006_01_02"},
+	{regexp.MustCompile(`\d{8}`), "20060102"},
+}
+
+// parseIndexDate 从索引名中解析日期，layout 为空时自动识别
+func parseIndexDate(index string, layout string) (t time.Time, ok bool) {
+	if layout != "" {
+		for i := 0; i+len(layout) <= len(index); i++ {
+			var err error
+			if t, err = time.Parse(layout, index[i:i+len(layout)]); err == nil {
+				return t, true
+			}
+		}
+		return
+	}
+	for _, p := range indexDatePatterns {
+		for _, s := range p.re.FindAllString(index, -1) {
+			var err error
+			if t, err = time.Parse(p.layout, s); err == nil {
+				return t, true
+			}
+		}
+	}
+	return
+}
+
+// SelectIndices 列出匹配的索引，选择早于指定时间并且尚未归档的索引，按日期排序
+func SelectIndices(ctx context.Context, opts IndexSelectOptions) (out []IndexCandidate, err error) {
+	if strings.TrimSpace(opts.Pattern) == "" {
+		err = errors.New("缺少索引匹配规则")
+		return
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	var res *elastic.Response
+	if res, err = opts.ESClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/_cat/indices/" + opts.Pattern,
+		Params: map[string][]string{
+			"format":           {"json"},
+			"h":                {"index,creation.date"},
+			"expand_wildcards": {"open,closed"},
+		},
+	}); err != nil {
+		return
+	}
+	var rows []struct {
+		Index        string `json:"index"`
+		CreationDate string `json:"creation.date"`
+	}
+	if err = json.Unmarshal(res.Body, &rows); err != nil {
+		return
+	}
+	deadline := opts.Now.Add(-opts.OlderThan)
+	for _, row := range rows {
+		// 跳过系统索引
+		if strings.HasPrefix(row.Index, ".") {
+			continue
+		}
+		c := IndexCandidate{Index: row.Index}
+		if t, ok := parseIndexDate(row.Index, opts.DateLayout); ok {
+			c.Date, c.DateSource = t, DateSourceName
+		} else if ms, err := strconv.ParseInt(row.CreationDate, 10, 64); err == nil {
+			c.Date, c.DateSource = time.Unix(0, ms*int64(time.Millisecond)), DateSourceCreationDate
+		} else {
+			joblog.Printf(ctx, "无法获取索引日期，跳过: %s", row.Index)
+			continue
+		}
+		if !c.Date.Before(deadline) {
+			continue
+		}
+		var archived bool
+		if archived, err = IndexArchived(ctx, opts.Storage, row.Index); err != nil {
+			return
+		}
+		if archived {
+			joblog.Printf(ctx, "索引已经归档，跳过: %s", row.Index)
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Date.Equal(out[j].Date) {
+			return out[i].Date.Before(out[j].Date)
+		}
+		return out[i].Index < out[j].Index
+	})
+	return
+}
+
+// IndexArchived 存储中存在描述文件，并且没有未完成的迁移进度
+func IndexArchived(ctx context.Context, store storage.Storage, index string) (ok bool, err error) {
+	if _, err = store.Head(ctx, index+"/"+FileManifest); err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	if _, err = store.Head(ctx, index+"/"+FileCheckpoint); err == nil {
+		return
+	} else if err != storage.ErrNotFound {
+		return
+	}
+	return true, nil
+}
@@ -0,0 +1,23 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseIndexDate(t *testing.T) {
+	day := time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC)
+	for _, index := range []string{"logs-2020-03-04", "logs-2020.03.04", "logs_2020_03_04-x", "logs-20200304", "v2-logs-2020.03.04"} {
+		d, ok := parseIndexDate(index, "")
+		assert.True(t, ok, index)
+		assert.Equal(t, day, d, index)
+	}
+	d, ok := parseIndexDate("logs-04-03-2020", "02-01-2006")
+	assert.True(t, ok)
+	assert.Equal(t, day, d)
+	_, ok = parseIndexDate("logs-current", "")
+	assert.False(t, ok)
+	_, ok = parseIndexDate("logs-20201399", "")
+	assert.False(t, ok)
+}
@@ -0,0 +1,312 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/buger/jsonparser"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FileManifest = "_manifest.json"
+
+	DefaultTimestampField = "@timestamp"
+)
+
+type ManifestCluster struct {
+	Name         string `json:"name"`
+	UUID         string `json:"uuid"`
+	Distribution string `json:"distribution"`
+	Version      string `json:"version"`
+}
+
+type ManifestCompression struct {
+	Format   string `json:"format"`
+	Level    int    `json:"level"`
+	Stream   bool   `json:"stream"`
+	PartSize int64  `json:"part_size,omitempty"`
+}
+
+type ProjectManifest struct {
+	Key               string     `json:"key"`
+	Documents         int64      `json:"documents"`
+	CompressedBytes   int64      `json:"compressed_bytes"`
+	UncompressedBytes int64      `json:"uncompressed_bytes"`
+	SHA256            string     `json:"sha256,omitempty"`
+	MinTimestamp      *time.Time `json:"min_timestamp,omitempty"`
+	MaxTimestamp      *time.Time `json:"max_timestamp,omitempty"`
+}
+
+// Manifest 索引归档的描述文件，保存在 INDEX/_manifest.json
+type Manifest struct {
+	Index          string                      `json:"index"`
+	Version        string                      `json:"esbridge_version"`
+	Cluster        ManifestCluster             `json:"cluster"`
+	Engine         string                      `json:"engine"`
+	Format         string                      `json:"format"`
+	Compression    ManifestCompression         `json:"compression"`
+	TimestampField string                      `json:"timestamp_field"`
+	CreatedAt      time.Time                   `json:"created_at"`
+	Projects       map[string]*ProjectManifest `json:"projects"`
+}
+
+func (opts IndexMigrateOptions) FilenameManifestRemote() string {
+	return opts.Index + "/" + FileManifest
+}
+
+func (opts IndexMigrateOptions) timestampField() string {
+	if opts.TimestampField == "" {
+		return DefaultTimestampField
+	}
+	return opts.TimestampField
+}
+
+// LoadManifest 读取索引的描述文件，不存在时返回 nil
+func LoadManifest(ctx context.Context, store storage.Storage, index string) (m *Manifest, err error) {
+	var rc io.ReadCloser
+	if rc, err = store.Get(ctx, index+"/"+FileManifest, 0, 0); err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	defer rc.Close()
+	var buf []byte
+	if buf, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+	m = &Manifest{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return
+	}
+	if m.Projects == nil {
+		m.Projects = map[string]*ProjectManifest{}
+	}
+	return
+}
+
+// writeManifest 根据迁移进度生成描述文件，保留之前描述文件中其他项目的记录
+func writeManifest(ctx context.Context, opts IndexMigrateOptions, projects []string) (m *Manifest, err error) {
+	if m, err = LoadManifest(ctx, opts.Storage, opts.Index); err != nil {
+		return
+	}
+	if m == nil {
+		m = &Manifest{Projects: map[string]*ProjectManifest{}}
+	}
+	m.Index = opts.Index
+	m.Version = opts.Version
+	m.Cluster = ManifestCluster{
+		Name:         opts.Cluster.ClusterName,
+		UUID:         opts.Cluster.ClusterUUID,
+		Distribution: opts.Cluster.Distribution,
+		Version:      opts.Cluster.Version,
+	}
+	m.Engine = opts.Engine
+	m.Format = FormatRecord
+	m.Compression = ManifestCompression{
+		Format: "gzip",
+		Level:  opts.CompressionLevel,
+		Stream: opts.Stream,
+	}
+	if opts.Stream {
+		m.Compression.PartSize = opts.PartSize
+	}
+	m.TimestampField = opts.timestampField()
+	m.CreatedAt = time.Now()
+	for _, p := range projects {
+		pm := opts.checkpoint.Project(p).Stats
+		if pm == nil {
+			if m.Projects[p] != nil {
+				continue
+			}
+			// 之前已经存在的归档，只能记录大小
+			key := opts.Index + "/" + p + ExtCompressedNDJSON
+			var obj storage.Object
+			if obj, err = opts.Storage.Head(ctx, key); err != nil {
+				return
+			}
+			pm = &ProjectManifest{Key: key, CompressedBytes: obj.Size}
+		}
+		m.Projects[p] = pm
+	}
+	var buf []byte
+	if buf, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return
+	}
+	err = opts.Storage.PutStream(ctx, opts.FilenameManifestRemote(), bytes.NewReader(buf), storage.PutOptions{})
+	return
+}
+
+// statsRecorder 统计写入的文档，并计算压缩后数据的 SHA256
+type statsRecorder struct {
+	ProjectManifest
+	field string
+	hash  hash.Hash
+
+	docs         metrics.Counter
+	uncompressed metrics.Counter
+	compressed   metrics.Counter
+}
+
+func newStatsRecorder(key string, field string) *statsRecorder {
+	r := &statsRecorder{
+		ProjectManifest: ProjectManifest{Key: key},
+		field:           field,
+		hash:            sha256.New(),
+	}
+	r.resolveMetrics()
+	return r
+}
+
+// restoreStatsRecorder 从进度文件中恢复统计
+func restoreStatsRecorder(field string, pm ProjectManifest, state []byte) (r *statsRecorder, err error) {
+	r = &statsRecorder{ProjectManifest: pm, field: field, hash: sha256.New()}
+	if err = r.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return
+	}
+	r.resolveMetrics()
+	return
+}
+
+// resolveMetrics 根据 Key (INDEX/PROJECT.ndjson.gz) 获取监控指标
+func (r *statsRecorder) resolveMetrics() {
+	index, project := splitArchiveKey(r.Key)
+	r.docs = metrics.DocumentsExported.With(index, project)
+	r.uncompressed = metrics.BytesUncompressed.With(index, project)
+	r.compressed = metrics.BytesCompressed.With(index, project)
+}
+
+// splitArchiveKey 从归档文件的路径中获取索引和项目
+func splitArchiveKey(key string) (index, project string) {
+	key = strings.TrimSuffix(key, ExtCompressedNDJSON)
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+func (r *statsRecorder) HashState() ([]byte, error) {
+	return r.hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// AddDocument 记录一行未压缩的归档记录，时间范围从 source 中获取
+func (r *statsRecorder) AddDocument(line []byte, source []byte) {
+	r.Documents++
+	r.UncompressedBytes += int64(len(line)) + 1
+	r.docs.Inc()
+	r.uncompressed.Add(float64(len(line) + 1))
+	if t, ok := extractTimestamp(source, r.field); ok {
+		if r.MinTimestamp == nil || t.Before(*r.MinTimestamp) {
+			r.MinTimestamp = &t
+		}
+		if r.MaxTimestamp == nil || t.After(*r.MaxTimestamp) {
+			r.MaxTimestamp = &t
+		}
+	}
+}
+
+// Merge 合并另一个统计中的文档记录，不包括压缩数据
+func (r *statsRecorder) Merge(o *statsRecorder) {
+	r.Documents += o.Documents
+	r.UncompressedBytes += o.UncompressedBytes
+	if o.MinTimestamp != nil && (r.MinTimestamp == nil || o.MinTimestamp.Before(*r.MinTimestamp)) {
+		r.MinTimestamp = o.MinTimestamp
+	}
+	if o.MaxTimestamp != nil && (r.MaxTimestamp == nil || o.MaxTimestamp.After(*r.MaxTimestamp)) {
+		r.MaxTimestamp = o.MaxTimestamp
+	}
+}
+
+// Write 记录压缩后的数据
+func (r *statsRecorder) Write(p []byte) (int, error) {
+	r.CompressedBytes += int64(len(p))
+	r.compressed.Add(float64(len(p)))
+	return r.hash.Write(p)
+}
+
+func (r *statsRecorder) Manifest() *ProjectManifest {
+	pm := r.ProjectManifest
+	pm.SHA256 = hex.EncodeToString(r.hash.Sum(nil))
+	return &pm
+}
+
+func extractTimestamp(doc []byte, field string) (t time.Time, ok bool) {
+	val, typ, found := lookupField(doc, field)
+	if !found {
+		return
+	}
+	switch typ {
+	case jsonparser.String:
+		return parseTimestamp(string(val))
+	case jsonparser.Number:
+		ms, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), true
+	}
+	return
+}
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+func parseTimestamp(s string) (t time.Time, ok bool) {
+	for _, layout := range timestampLayouts {
+		var err error
+		if t, err = time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), true
+	}
+	return
+}
+
+// ManifestVerifier 恢复时校验读取的数据与描述文件是否一致
+type ManifestVerifier struct {
+	pm    *ProjectManifest
+	hash  hash.Hash
+	bytes int64
+}
+
+func NewManifestVerifier(pm *ProjectManifest) *ManifestVerifier {
+	return &ManifestVerifier{pm: pm, hash: sha256.New()}
+}
+
+func (v *ManifestVerifier) Write(p []byte) (int, error) {
+	v.bytes += int64(len(p))
+	return v.hash.Write(p)
+}
+
+func (v *ManifestVerifier) Verify(docs int64) error {
+	if v.pm.CompressedBytes > 0 && v.bytes != v.pm.CompressedBytes {
+		return errors.New("归档大小与描述文件不一致: " + strconv.FormatInt(v.bytes, 10) + " != " + strconv.FormatInt(v.pm.CompressedBytes, 10))
+	}
+	if v.pm.SHA256 != "" {
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.pm.SHA256 {
+			return errors.New("归档 SHA256 与描述文件不一致: " + sum + " != " + v.pm.SHA256)
+		}
+	}
+	if v.pm.SHA256 != "" && docs != v.pm.Documents {
+		return errors.New("归档文档数与描述文件不一致: " + strconv.FormatInt(docs, 10) + " != " + strconv.FormatInt(v.pm.Documents, 10))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestExtractTimestamp(t *testing.T) {
+	t1, ok := extractTimestamp([]byte(`{"@timestamp":"2020-01-02T03:04:05.678+08:00"}`), "@timestamp")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 1, 1, 19, 4, 5, 678000000, time.UTC), t1)
+	t2, ok := extractTimestamp([]byte(`{"log":{"time":1577934245000}}`), "log.time")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), t2)
+	_, ok = extractTimestamp([]byte(`{"message":"hello"}`), "@timestamp")
+	assert.False(t, ok)
+
+	r := newStatsRecorder("index-a/project-a.ndjson.gz", "ts")
+	r.AddDocument([]byte(`{"_source":{"ts":"2020-01-02"}}`), []byte(`{"ts":"2020-01-02"}`))
+	r.AddDocument([]byte(`{"_source":{"ts":"2020-01-01"}}`), []byte(`{"ts":"2020-01-01"}`))
+	assert.Equal(t, int64(2), r.Documents)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), *r.MinTimestamp)
+	assert.Equal(t, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), *r.MaxTimestamp)
+}
+
+func TestSplitArchiveKey(t *testing.T) {
+	index, project := splitArchiveKey("index-a/project-a.ndjson.gz")
+	assert.Equal(t, "index-a", index)
+	assert.Equal(t, "project-a", project)
+}
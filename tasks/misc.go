@@ -1,15 +1,16 @@
 package tasks
 
 import (
-	"log"
+	"context"
+	"github.com/guoyk93/esbridge/joblog"
 	"runtime"
 	"runtime/debug"
 )
 
-func PrintMemUsageAndGC(label string) {
+func PrintMemUsageAndGC(ctx context.Context, label string) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-	log.Printf("%s 内存占用: %vmb / %vmb",
+	joblog.Printf(ctx, "%s 内存占用: %vmb / %vmb",
 		label,
 		m.Alloc/1024/1024,
 		m.Sys/1024/1024,
@@ -4,20 +4,23 @@ import (
 	"context"
 	"fmt"
 	"github.com/guoyk93/conc"
-	"github.com/guoyk93/esexporter"
-	"github.com/guoyk93/logutil"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/guoyk93/esbridge/metrics"
+	"github.com/guoyk93/esbridge/storage"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/olivere/elastic"
-	"github.com/tencentyun/cos-go-sdk-v5"
-	"log"
-	"net/http"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"runtime"
+	"strings"
+	"sync"
 )
 
 const (
 	ExtCompressedNDJSON = ".ndjson.gz"
+	// ExtDeadLetter 恢复时无法写入的文档
+	ExtDeadLetter = ".deadletter" + ExtCompressedNDJSON
 )
 
 var (
@@ -37,89 +40,170 @@ func (opts ProjectMigrateOptions) FilenameRemote() string {
 	return opts.Index + "/" + opts.Project + ExtCompressedNDJSON
 }
 
+// IsArchiveKey 判断存储中的文件是否为项目的归档，排除元数据文件和死信文件
+func IsArchiveKey(key string) bool {
+	return !strings.HasPrefix(path.Base(key), "_") &&
+		strings.HasSuffix(key, ExtCompressedNDJSON) &&
+		!strings.HasSuffix(key, ExtDeadLetter)
+}
+
 func ProjectMigrate(opts ProjectMigrateOptions) conc.Task {
-	return conc.TaskFunc(func(ctx context.Context) error {
-		res, err := opts.COSClient.Object.Head(ctx, opts.FilenameRemote(), nil)
-		if err == nil && res.StatusCode == http.StatusOK {
-			log.Printf("索引/项目已经存在: %s/%s", opts.Index, opts.Project)
-			return nil
-		}
-		return conc.Serial(
-			ProjectExportCompressedData(opts),
-			ProjectUploadCompressedData(opts),
-		).Do(ctx)
+	return conc.TaskFunc(func(ctx context.Context) (err error) {
+		store := opts.checkpoint
+		if store != nil && store.Project(opts.Project).Done {
+			joblog.Printf(ctx, "索引/项目已经完成: %s/%s", opts.Index, opts.Project)
+			return
+		}
+		if obj, hErr := opts.Storage.Head(ctx, opts.FilenameRemote()); hErr == nil {
+			var m *Manifest
+			if m, err = LoadManifest(ctx, opts.Storage, opts.Index); err != nil {
+				return
+			}
+			var pm *ProjectManifest
+			if m != nil {
+				pm = m.Projects[opts.Project]
+			}
+			// 沿用描述文件中的统计，没有完整统计的归档无法校验文档数，重新导出
+			if pm != nil && pm.SHA256 != "" && pm.CompressedBytes == obj.Size {
+				joblog.Printf(ctx, "索引/项目已经存在: %s/%s", opts.Index, opts.Project)
+				if store == nil {
+					return
+				}
+				store.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+					p.Done = true
+					p.Stats = pm
+				})
+				return store.Save(ctx)
+			}
+			joblog.Printf(ctx, "索引/项目已经存在，但是没有完整的描述信息，重新导出: %s/%s", opts.Index, opts.Project)
+		}
+		if opts.Stream {
+			return ProjectStreamCompressedData(opts).Do(ctx)
+		}
+		if store == nil {
+			return conc.Serial(
+				ProjectExportCompressedData(opts),
+				ProjectUploadCompressedData(opts),
+			).Do(ctx)
+		}
+		if _, err := os.Stat(opts.FilenameLocal()); err != nil || !store.Project(opts.Project).Exported {
+			if err = ProjectExportCompressedData(opts).Do(ctx); err != nil {
+				return err
+			}
+			store.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+				p.Exported = true
+			})
+			if err = store.Save(ctx); err != nil {
+				return err
+			}
+		} else {
+			joblog.Printf(ctx, "本地文件已经导出: %s/%s", opts.Index, opts.Project)
+		}
+		if err = ProjectUploadCompressedData(opts).Do(ctx); err != nil {
+			return
+		}
+		store.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+			p.Done = true
+		})
+		return store.Save(ctx)
 	})
 }
 
 func ProjectExportCompressedData(opts ProjectMigrateOptions) conc.Task {
 	return conc.TaskFunc(func(ctx context.Context) (err error) {
 		title := fmt.Sprintf("导出项目数据到本地: %s/%s", opts.Index, opts.Project)
-		log.Println(title)
+		joblog.Println(ctx, title)
 
 		if err = os.MkdirAll(opts.Workspace(), 0755); err != nil {
 			return
 		}
 
 		var zf *os.File
-		if zf, err = os.OpenFile(opts.FilenameLocal(), os.O_CREATE|os.O_RDWR, 0640); err != nil {
+		if zf, err = os.OpenFile(opts.FilenameLocal(), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0640); err != nil {
 			return
 		}
 		defer zf.Close()
 
+		stats := newStatsRecorder(opts.FilenameRemote(), opts.timestampField())
+
 		var zw *gzip.Writer
-		if zw, err = gzip.NewWriterLevel(zf, gzip.BestCompression); err != nil {
+		if zw, err = gzip.NewWriterLevel(io.MultiWriter(zf, stats), gzip.BestCompression); err != nil {
 			return
 		}
 		defer zw.Close()
 
-		prg := logutil.NewProgress(logutil.LoggerFunc(log.Printf), title)
-
-		task := conc.TaskFunc(func(ctx context.Context) error {
-			return esexporter.New(opts.ESClient, esexporter.Options{
-				Index:     opts.Index,
-				Query:     elastic.NewTermQuery("project", opts.Project),
-				Type:      "_doc",
-				Scroll:    "10m",
-				BatchSize: int64(opts.BatchSize),
-			}, func(buf []byte, id int64, total int64) (err error) {
-				prg.SetTotal(total)
-				prg.SetCount(id + 1)
-				if _, err = zw.Write(buf); err != nil {
-					return
-				}
-				if _, err = zw.Write(newLine); err != nil {
-					return
-				}
+		var lock sync.Mutex
+		if err = exportDocuments(ctx, opts.IndexMigrateOptions, elastic.NewTermQuery("project", opts.Project), title, nil, func(line []byte, source []byte, slice int, cursor []interface{}) (err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if _, err = zw.Write(line); err != nil {
 				return
-			}).Do(ctx)
-		})
+			}
+			if _, err = zw.Write(newLine); err != nil {
+				return
+			}
+			stats.AddDocument(line, source)
+			return
+		}); err != nil {
+			return
+		}
 
-		if err = task.Do(ctx); err != nil {
+		if err = zw.Close(); err != nil {
 			return
 		}
+		if opts.checkpoint != nil {
+			opts.checkpoint.UpdateProject(opts.Project, func(p *ProjectCheckpoint) {
+				p.Stats = stats.Manifest()
+			})
+		}
 
-		PrintMemUsageAndGC(title)
+		PrintMemUsageAndGC(ctx, title)
+		return
+	})
+}
+
+func ProjectStreamCompressedData(opts ProjectMigrateOptions) conc.Task {
+	return conc.TaskFunc(func(ctx context.Context) (err error) {
+		title := fmt.Sprintf("导出项目数据到存储: %s/%s", opts.Index, opts.Project)
+		joblog.Println(ctx, title)
+
+		var w *archiveWriter
+		if w, err = newArchiveWriter(ctx, opts, opts.checkpoint); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				w.Abort()
+			}
+		}()
+
+		if err = exportDocuments(ctx, opts.IndexMigrateOptions, elastic.NewTermQuery("project", opts.Project), title, w.Cursors(), func(line []byte, source []byte, slice int, cursor []interface{}) error {
+			return w.Write(ctx, line, source, slice, cursor)
+		}); err != nil {
+			return
+		}
+
+		if err = w.Close(ctx); err != nil {
+			return
+		}
+
+		PrintMemUsageAndGC(ctx, title)
 		return
 	})
 }
 
 func ProjectUploadCompressedData(opts ProjectMigrateOptions) conc.Task {
 	return conc.TaskFunc(func(ctx context.Context) (err error) {
-		log.Printf("上传本地文件: %s/%s", opts.Index, opts.Project)
-		if _, _, err = opts.COSClient.Object.Upload(ctx,
-			opts.FilenameRemote(),
-			opts.FilenameLocal(),
-			&cos.MultiUploadOptions{
-				PartSize:       1000,
-				ThreadPoolSize: runtime.NumCPU(),
-				OptIni: &cos.InitiateMultipartUploadOptions{
-					ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosStorageClass: "STANDARD_IA"},
-				},
-			},
-		); err != nil {
+		joblog.Printf(ctx, "上传本地文件: %s/%s", opts.Index, opts.Project)
+		var fi os.FileInfo
+		if fi, err = os.Stat(opts.FilenameLocal()); err != nil {
+			return
+		}
+		if err = opts.Storage.Put(ctx, opts.FilenameRemote(), opts.FilenameLocal(), storage.PutOptions{StorageClass: opts.StorageClass}); err != nil {
 			return
 		}
-		log.Printf("删除本地文件: %s/%s", opts.Index, opts.Project)
+		metrics.BytesUploaded.With(opts.Index, opts.Project).Add(float64(fi.Size()))
+		joblog.Printf(ctx, "删除本地文件: %s/%s", opts.Index, opts.Project)
 		if err = os.Remove(opts.FilenameLocal()); err != nil {
 			return
 		}
@@ -27,3 +27,9 @@ func TestChanClose(t *testing.T) {
 	wg.Wait()
 	assert.Equal(t, total, count)
 }
+
+func TestIsArchiveKey(t *testing.T) {
+	assert.True(t, IsArchiveKey("index-a/project-a.ndjson.gz"))
+	assert.False(t, IsArchiveKey("index-a/_manifest.json"))
+	assert.False(t, IsArchiveKey("index-a/project-a.deadletter.ndjson.gz"))
+}
@@ -0,0 +1,84 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/buger/jsonparser"
+)
+
+const (
+	// FormatRecord 归档中的每一行为包含元数据的记录
+	FormatRecord = "record"
+	// FormatSource 旧版本的归档，每一行只有 _source
+	FormatSource = "source"
+)
+
+// Record 归档中的一行，包含文档的元数据和 _source
+type Record struct {
+	Index   string          `json:"_index"`
+	Type    string          `json:"_type,omitempty"`
+	ID      string          `json:"_id"`
+	Routing string          `json:"_routing,omitempty"`
+	Version int64           `json:"_version,omitempty"`
+	Source  json.RawMessage `json:"_source"`
+}
+
+// encodeRecord 将 hits.hits 中的元素转换为归档记录，同时返回 _source
+func encodeRecord(hit []byte) (line []byte, source []byte, err error) {
+	var typ jsonparser.ValueType
+	if source, typ, _, err = jsonparser.Get(hit, "_source"); err != nil {
+		return
+	}
+	if typ != jsonparser.Object {
+		err = errors.New("missing _source in hits.hits")
+		return
+	}
+	line = make([]byte, 0, len(source)+128)
+	line = append(line, '{')
+	for _, key := range []string{"_index", "_type", "_id", "_routing"} {
+		var val []byte
+		if val, typ, _, err = jsonparser.Get(hit, key); err != nil {
+			if err == jsonparser.KeyPathNotFoundError {
+				err = nil
+				continue
+			}
+			return
+		}
+		if typ != jsonparser.String {
+			continue
+		}
+		line = append(line, '"')
+		line = append(line, key...)
+		line = append(line, '"', ':', '"')
+		// 保持原有的转义
+		line = append(line, val...)
+		line = append(line, '"', ',')
+	}
+	var version []byte
+	if version, typ, _, err = jsonparser.Get(hit, "_version"); err == nil && typ == jsonparser.Number {
+		line = append(line, `"_version":`...)
+		line = append(line, version...)
+		line = append(line, ',')
+	}
+	err = nil
+	line = append(line, `"_source":`...)
+	line = append(line, source...)
+	line = append(line, '}')
+	return
+}
+
+// ParseRecord 解析归档中的一行，兼容只有 _source 的旧版本归档
+func ParseRecord(buf []byte) (r Record, err error) {
+	// 不合法的行会原样写入 bulk 请求，导致整个批次失败
+	if !json.Valid(buf) || len(buf) == 0 || buf[0] != '{' {
+		err = errors.New("归档中的行不是合法的 JSON 对象")
+		return
+	}
+	// 文档中不允许出现 _source 字段，因此可以用于区分两种格式
+	if _, typ, _, err := jsonparser.Get(buf, "_source"); err != nil || typ != jsonparser.Object {
+		r.Source = buf
+		return r, nil
+	}
+	err = json.Unmarshal(buf, &r)
+	return
+}
@@ -0,0 +1,42 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeRecord(t *testing.T) {
+	hit := []byte(`{"_index":"index-a","_type":"_doc","_id":"a\"1","_score":null,"_routing":"r1","_version":3,"_source":{"project":"p","n":1},"sort":[1]}`)
+	line, source, err := encodeRecord(hit)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"project":"p","n":1}`, string(source))
+	assert.Equal(t, `{"_index":"index-a","_type":"_doc","_id":"a\"1","_routing":"r1","_version":3,"_source":{"project":"p","n":1}}`, string(line))
+
+	r, err := ParseRecord(line)
+	assert.NoError(t, err)
+	assert.Equal(t, "index-a", r.Index)
+	assert.Equal(t, "_doc", r.Type)
+	assert.Equal(t, `a"1`, r.ID)
+	assert.Equal(t, "r1", r.Routing)
+	assert.Equal(t, int64(3), r.Version)
+	assert.Equal(t, `{"project":"p","n":1}`, string(r.Source))
+
+	_, _, err = encodeRecord([]byte(`{"_id":"1"}`))
+	assert.Error(t, err)
+}
+
+func TestParseRecordLegacy(t *testing.T) {
+	r, err := ParseRecord([]byte(`{"project":"p","_id_like":"x"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", r.ID)
+	assert.Equal(t, `{"project":"p","_id_like":"x"}`, string(r.Source))
+}
+
+func TestParseRecordMalformed(t *testing.T) {
+	_, err := ParseRecord([]byte(`{"_index":"index-a","_id":"1","_source":{"project":"p","n":`))
+	assert.Error(t, err)
+	_, err = ParseRecord([]byte(`{"project":"p"`))
+	assert.Error(t, err)
+	_, err = ParseRecord([]byte(`"p"`))
+	assert.Error(t, err)
+}
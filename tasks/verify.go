@@ -0,0 +1,117 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guoyk93/esbridge/joblog"
+	"github.com/olivere/elastic"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// countDiscrepancy 索引与归档文档数的对比
+type countDiscrepancy struct {
+	Project  string
+	Index    int64
+	Archived int64
+	// Unknown 归档没有记录文档数，无法校验
+	Unknown bool
+}
+
+func (d countDiscrepancy) OK() bool {
+	return !d.Unknown && d.Index == d.Archived
+}
+
+// indexCount 获取索引的文档总数
+func indexCount(ctx context.Context, opts IndexMigrateOptions) (count int64, err error) {
+	var res *elastic.Response
+	if res, err = opts.ESClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/" + opts.Index + "/_count",
+	}); err != nil {
+		return
+	}
+	var body struct {
+		Count int64 `json:"count"`
+	}
+	if err = json.Unmarshal(res.Body, &body); err != nil {
+		return
+	}
+	count = body.Count
+	return
+}
+
+// compareCounts 对比索引与描述文件中的文档数，返回所有项目的对比结果以及是否全部一致
+func compareCounts(total int64, counts []projectCount, missing int64, m *Manifest) (ds []countDiscrepancy, ok bool) {
+	ok = true
+	var sumIndex, sumArchived int64
+	for _, c := range counts {
+		d := countDiscrepancy{Project: c.Project, Index: c.Documents}
+		if pm := m.Projects[c.Project]; pm != nil && pm.SHA256 != "" {
+			d.Archived = pm.Documents
+		} else {
+			d.Unknown = true
+		}
+		sumIndex += d.Index
+		sumArchived += d.Archived
+		ok = ok && d.OK()
+		ds = append(ds, d)
+	}
+	if missing > 0 {
+		// 缺少项目字段的文档不会被导出
+		ds = append(ds, countDiscrepancy{Project: "(缺少 " + keyProject + " 字段)", Index: missing})
+		sumIndex += missing
+		ok = false
+	}
+	d := countDiscrepancy{Project: "(_count)", Index: total, Archived: sumArchived}
+	ok = ok && d.OK() && sumIndex == total
+	ds = append(ds, d)
+	return
+}
+
+func formatDiscrepancies(ds []countDiscrepancy) string {
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "项目\t索引\t归档\t差异\t")
+	for _, d := range ds {
+		archived, diff := strconv.FormatInt(d.Archived, 10), strconv.FormatInt(d.Index-d.Archived, 10)
+		if d.Unknown {
+			archived, diff = "未知", "-"
+		}
+		mark := ""
+		if !d.OK() {
+			mark = "*"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", d.Project, d.Index, archived, diff, mark)
+	}
+	_ = tw.Flush()
+	return buf.String()
+}
+
+// indexVerifyCounts 删除索引之前，确认归档中包含索引中的全部文档
+func indexVerifyCounts(ctx context.Context, opts IndexMigrateOptions, m *Manifest) (err error) {
+	var total int64
+	if total, err = indexCount(ctx, opts); err != nil {
+		return
+	}
+	var counts []projectCount
+	var missing int64
+	if counts, missing, err = indexCountProjects(ctx, opts); err != nil {
+		return
+	}
+	ds, ok := compareCounts(total, counts, missing, m)
+	if ok {
+		joblog.Printf(ctx, "归档文档数与索引一致: %s, %d", opts.Index, total)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(formatDiscrepancies(ds)), "\n") {
+		joblog.Println(ctx, line)
+	}
+	err = errors.New("归档文档数与索引不一致，拒绝删除索引: " + opts.Index)
+	return
+}
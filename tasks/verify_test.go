@@ -0,0 +1,32 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompareCounts(t *testing.T) {
+	m := &Manifest{Projects: map[string]*ProjectManifest{
+		"a": {Documents: 10, SHA256: "x"},
+		"b": {Documents: 5, SHA256: "x"},
+		"c": {CompressedBytes: 100},
+	}}
+
+	ds, ok := compareCounts(15, []projectCount{{"a", 10}, {"b", 5}}, 0, m)
+	assert.True(t, ok)
+	assert.Len(t, ds, 3)
+
+	ds, ok = compareCounts(16, []projectCount{{"a", 10}, {"b", 5}}, 1, m)
+	assert.False(t, ok)
+	assert.Len(t, ds, 4)
+
+	ds, ok = compareCounts(16, []projectCount{{"a", 11}, {"b", 5}}, 0, m)
+	assert.False(t, ok)
+	assert.False(t, ds[0].OK())
+	assert.True(t, ds[1].OK())
+
+	ds, ok = compareCounts(3, []projectCount{{"c", 3}}, 0, m)
+	assert.False(t, ok)
+	assert.True(t, ds[0].Unknown)
+	assert.Contains(t, formatDiscrepancies(ds), "未知")
+}